@@ -4,10 +4,9 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"io"
 	"io/ioutil"
-	"log"
-	"os"
 )
 
 /*
@@ -16,56 +15,70 @@ import (
 
 type Cipher struct {
 	block cipher.Block
+	gcm   cipher.AEAD
 }
 
-func AES(key []byte) Cipher {
+// The size of the nonces used by Seal and Open
+const NonceSize = 12
+
+var ErrShortCiphertext = errors.New("aes: ciphertext is shorter than the iv")
+
+// Returns a cipher using the key, which must be 16, 24 or 32 bytes long.
+func AES(key []byte) (Cipher, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		log.Fatal(err)
+		return Cipher{}, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return Cipher{}, err
 	}
 
 	return Cipher{
 		block: block,
-	}
+		gcm:   gcm,
+	}, nil
+}
+
+// Encrypts and authenticates the plaintext and the additional data using GCM.
+// A nonce must never be used twice with the same key.
+func (c *Cipher) Seal(nonce []byte, plaintext []byte, additionalData []byte) []byte {
+	return c.gcm.Seal(nil, nonce, plaintext, additionalData)
+}
+
+// Decrypts a ciphertext made by Seal, and returns an error if it or the
+// additional data has been tampered with.
+func (c *Cipher) Open(nonce []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	return c.gcm.Open(nil, nonce, ciphertext, additionalData)
 }
 
-func (c *Cipher) EncryptToFile(file string, plaintext []byte) {
+func (c *Cipher) EncryptToFile(file string, plaintext []byte) error {
 	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
 	iv := ciphertext[:aes.BlockSize]
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		panic(err)
+		return err
 	}
 
 	stream := cipher.NewCTR(c.block, iv)
 	stream.XORKeyStream(ciphertext[aes.BlockSize:], plaintext)
 
-	f, err := os.Create(file)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
-
-	err = ioutil.WriteFile(file, ciphertext, 0777)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return ioutil.WriteFile(file, ciphertext, 0777)
 }
 
-func (c *Cipher) DecryptFromFile(encryptedFile string) []byte {
-	file, err := os.Open(encryptedFile)
+func (c *Cipher) DecryptFromFile(encryptedFile string) ([]byte, error) {
+	ciphertext, err := ioutil.ReadFile(encryptedFile)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer file.Close()
-
-	ciphertext, err := ioutil.ReadAll(file)
-	if err != nil {
-		log.Fatal(err)
+	if len(ciphertext) < aes.BlockSize {
+		return nil, ErrShortCiphertext
 	}
+
 	iv := ciphertext[:aes.BlockSize]
 	plaintext := make([]byte, len(ciphertext)-aes.BlockSize)
 
 	stream := cipher.NewCTR(c.block, iv)
 	stream.XORKeyStream(plaintext, ciphertext[aes.BlockSize:])
-	return plaintext
+	return plaintext, nil
 }
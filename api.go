@@ -0,0 +1,372 @@
+package dsys
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The address the API of a peer is served on by default. It is only meant to
+// be reached from the machine the peer runs on.
+const DefaultAPIAddress = "127.0.0.1:7070"
+
+// How long a client gets to send a request, and the API to answer one. The
+// events are streamed for as long as the client listens.
+const (
+	apiReadTimeout  = 10 * time.Second
+	apiWriteTimeout = 30 * time.Second
+	apiIdleTimeout  = time.Minute
+)
+
+// The body of a request to send money.
+type SendRequest struct {
+	To     string // The alias or key of the account
+	Amount int
+}
+
+// The body of an answer to a request that failed.
+type APIError struct {
+	Error string
+}
+
+// Serves the local API of the peer on http://address until the peer is
+// closed. Every request must carry the token as "Authorization: Bearer TOKEN"
+// unless it is empty, and requests from browsers, which carry an Origin or a
+// Host that is not an address, are refused. Requests and answers are JSON:
+//
+//	GET    /balance?account=ACCOUNT  the Balance of an account, by default ours
+//	GET    /balances                 the Balance of every account
+//	POST   /send                     sends money as given by a SendRequest
+//	GET    /history                  the TransactionStatus of our transactions
+//	GET    /transactions/ID          the TransactionStatus of a transaction
+//	POST   /transactions             submits a SignedTransaction
+//	GET    /peers                    the PeerInfo of the peers we know of
+//	GET    /head                     the last Block of the chain we follow
+//	GET    /blocks?slot=SLOT         the Blocks of a slot
+//	GET    /blocks/HASH              the Block with the hash
+//	GET    /bans                     the Bans of peers that misbehaved
+//	DELETE /bans                     lifts every ban, and answers the Bans left
+//	DELETE /bans/PEER                lifts the ban of a peer, and answers the Bans left
+//	GET    /events                   the Events of the peer, as server-sent events
+func (p *Peer) ServeAPI(address string, token string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	p.apiListener = ln
+	server := &http.Server{
+		Handler:           p.apiHandler(token),
+		ReadHeaderTimeout: apiReadTimeout,
+		ReadTimeout:       apiReadTimeout,
+		IdleTimeout:       apiIdleTimeout,
+	}
+	go server.Serve(ln)
+	fmt.Printf("%s is serving its API on: %s\n", p.info.Alias, ln.Addr())
+	return nil
+}
+
+// Reads the token of the API from the file. If the file does not exist, a new
+// token is generated and written to it.
+func LoadAPIToken(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+	if err := os.WriteFile(file, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (p *Peer) apiHandler(token string) http.Handler {
+	// The server has no write timeout, which would cut the events off, so
+	// the other answers get one of their own
+	mux := http.NewServeMux()
+	mux.HandleFunc("/balance", p.handleBalance)
+	mux.HandleFunc("/balances", p.handleBalances)
+	mux.HandleFunc("/send", p.handleSend)
+	mux.HandleFunc("/history", p.handleHistory)
+	mux.HandleFunc("/transactions", p.handleSubmit)
+	mux.HandleFunc("/transactions/", p.handleTransaction)
+	mux.HandleFunc("/peers", p.handlePeers)
+	mux.HandleFunc("/head", p.handleHead)
+	mux.HandleFunc("/blocks", p.handleBlocks)
+	mux.HandleFunc("/blocks/", p.handleBlock)
+	mux.HandleFunc("/bans", p.handleBans)
+	mux.HandleFunc("/bans/", p.handleUnban)
+	timed := http.TimeoutHandler(mux, apiWriteTimeout, `{"Error":"timed out"}`)
+
+	routes := http.NewServeMux()
+	routes.Handle("/", timed)
+	routes.HandleFunc("/events", p.handleEvents)
+	return guardAPI(token, routes)
+}
+
+// Refuses requests that do not carry the token, that come from a browser, or
+// that post something other than JSON.
+func guardAPI(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// A page can make a browser send requests to us, even under a name
+		// of its own that resolves to us
+		if req.Header.Get("Origin") != "" || !addressHost(req.Host) {
+			writeJSON(w, http.StatusForbidden, APIError{Error: "requests from browsers are not allowed"})
+			return
+		}
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, APIError{Error: "missing or wrong API token"})
+			return
+		}
+		if req.Method == http.MethodPost {
+			mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				writeJSON(w, http.StatusUnsupportedMediaType, APIError{Error: "the body must be application/json"})
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Reports whether the host of a request is an address or localhost, rather
+// than a name a page could have pointed at us.
+func addressHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	return host == "localhost" || net.ParseIP(host) != nil
+}
+
+func (p *Peer) handleBalance(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	balance, err := p.Balance(req.URL.Query().Get("account"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, balance)
+}
+
+func (p *Peer) handleBalances(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, p.Balances())
+}
+
+func (p *Peer) handleSend(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+	var send SendRequest
+	if err := json.NewDecoder(req.Body).Decode(&send); err != nil {
+		writeJSON(w, http.StatusBadRequest, APIError{Error: err.Error()})
+		return
+	}
+	if send.Amount < 1 {
+		writeError(w, ErrInvalidAmount)
+		return
+	}
+
+	id, err := p.SendTransaction(send.To, send.Amount)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status, err := p.Transaction(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (p *Peer) handleHistory(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, p.History())
+}
+
+func (p *Peer) handleTransaction(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	status, err := p.Transaction(strings.TrimPrefix(req.URL.Path, "/transactions/"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (p *Peer) handleSubmit(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+	var st SignedTransaction
+	if err := json.NewDecoder(req.Body).Decode(&st); err != nil {
+		writeJSON(w, http.StatusBadRequest, APIError{Error: err.Error()})
+		return
+	}
+
+	status, err := p.SubmitTransaction(st)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (p *Peer) handlePeers(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, p.Peers())
+}
+
+func (p *Peer) handleHead(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, p.Head())
+}
+
+func (p *Peer) handleBlocks(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	slot, err := strconv.Atoi(req.URL.Query().Get("slot"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, APIError{Error: "slot must be a number"})
+		return
+	}
+	writeJSON(w, http.StatusOK, p.BlocksAt(slot))
+}
+
+func (p *Peer) handleBlock(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	block, err := p.Block(strings.TrimPrefix(req.URL.Path, "/blocks/"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, block)
+}
+
+func (p *Peer) handleBans(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	if req.Method == http.MethodDelete {
+		p.ClearBans()
+	}
+	writeJSON(w, http.StatusOK, p.Bans())
+}
+
+func (p *Peer) handleUnban(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodDelete) {
+		return
+	}
+	if err := p.Unban(strings.TrimPrefix(req.URL.Path, "/bans/")); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p.Bans())
+}
+
+// Streams the events of the peer until the client goes away or the peer shuts
+// down. Each event is named after its kind and carries the Event as data.
+func (p *Peer) handleEvents(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, APIError{Error: "streaming is not supported"})
+		return
+	}
+
+	events, cancel := p.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Kind, b)
+			flusher.Flush()
+		}
+	}
+}
+
+// Answers with 405 and returns false if the request does not use one of the
+// methods.
+func allowMethod(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, APIError{Error: "method not allowed"})
+	return false
+}
+
+// Answers with the error and a status code that fits it.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrUnknownAccount), errors.Is(err, ErrUnknownTransaction), errors.Is(err, ErrUnknownBlock), errors.Is(err, ErrNotBanned):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrKnownTransaction):
+		status = http.StatusConflict
+	case errors.Is(err, ErrInvalidAmount), errors.Is(err, ErrInvalidTransaction), errors.Is(err, ErrBadKey), errors.Is(err, ErrBadSignature):
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, APIError{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
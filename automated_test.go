@@ -1,16 +1,32 @@
-package main
+package dsys
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"dsys/rpc"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 )
 
+const (
+	networkSeed = 1
+	waitTimeout = 10 * time.Second
+)
+
 func TestMain(m *testing.M) {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	code := m.Run()
@@ -18,7 +34,7 @@ func TestMain(m *testing.M) {
 }
 
 func TestTransactions(t *testing.T) {
-	peerList := createAndConnectNPeers(10)
+	peerList := createAndConnectNPeers(t, 10)
 
 	for i := 0; i < 20; i++ {
 		randomTransactions(peerList, 100, 1000, 10)
@@ -40,7 +56,7 @@ func TestTransactions(t *testing.T) {
 }
 
 func TestTransactionsTooBig(t *testing.T) {
-	peerList := createAndConnectNPeers(10)
+	peerList := createAndConnectNPeers(t, 10)
 
 	for i := 0; i < 20; i++ {
 		randomTransactions(peerList, 100, 1000000, 1)
@@ -59,7 +75,7 @@ func TestTransactionsTooBig(t *testing.T) {
 }
 
 func TestTransactionsTooSmall(t *testing.T) {
-	peerList := createAndConnectNPeers(10)
+	peerList := createAndConnectNPeers(t, 10)
 
 	for i := 0; i < 20; i++ {
 		from := rand.Intn(len(peerList))
@@ -79,36 +95,930 @@ func TestTransactionsTooSmall(t *testing.T) {
 	printAccounts(peerList)
 }
 
-func createAndConnectNPeers(n int) []*peer {
-	port := 64000
-	peerList := []*peer{}
+func TestForgedTransactionsBan(t *testing.T) {
+	peerList := createAndConnectNPeers(t, 2)
+	honest, forger := peerList[0], peerList[1]
+
+	conn := forger.rpc.Connections()[0]
+	for i := 0; i < 3; i++ {
+		st, err := forger.createSignedTransaction(honest.info.Alias, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.Transaction.Amount = 1000
+		forger.rpc.Send("transaction", st, conn, true)
+	}
+
+	waitFor(t, func() bool {
+		return len(honest.Bans()) == 1
+	})
+
+	// An operator sees the ban and lifts it through the API
+	server := httptest.NewServer(honest.apiHandler(""))
+	defer server.Close()
+	var bans []Ban
+	if status := getJSON(t, server.URL+"/bans", &bans); status != http.StatusOK || len(bans) != 1 {
+		t.Fatalf("expected one ban, got %d bans and status %d", len(bans), status)
+	}
+	res := apiRequest(t, http.MethodDelete, server.URL+"/bans/"+bans[0].Peer, "", func(*http.Request) {})
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || len(honest.Bans()) != 0 {
+		t.Errorf("expected the ban to be lifted, got status %d", res.StatusCode)
+	}
+	res = apiRequest(t, http.MethodDelete, server.URL+"/bans/"+bans[0].Peer, "", func(*http.Request) {})
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected %d for a peer that is not banned, got %d", http.StatusNotFound, res.StatusCode)
+	}
+
+	for _, p := range peerList {
+		p.Close()
+	}
+}
+
+func TestPresenceHijack(t *testing.T) {
+	// Only a peer can announce itself, and a presence can not take an alias
+	// bound to another key
+	p := createPeer("a")
+	victim := createPeer("b")
+	impostor := createPeer("b")
+	for _, x := range []*Peer{victim, impostor} {
+		x.info.Address = "peer" + x.info.Alias
+		x.info.Signature, _ = x.sign(x.info.Alias, x.info.Address, x.info.Pk)
+	}
+	if err := p.receivedPresence(nil, victim.info); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := victim.info
+	forged.Pk = impostor.info.Pk
+	if err := p.receivedPresence(nil, forged); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("expected %v for a presence signed by another, got %v", ErrBadSignature, err)
+	}
+	if err := p.receivedPresence(nil, impostor.info); !errors.Is(err, rpc.ErrNotForwarded) {
+		t.Errorf("expected a presence with a taken alias not to be forwarded, got %v", err)
+	}
+	if p.ledger.aliasToPk("b") != encodePk(victim.info.Pk) {
+		t.Error("expected the alias to stay bound to the key of the first peer")
+	}
+	if len(p.peerInfoList) != 1 {
+		t.Errorf("expected only the first peer in the list, got %d peers", len(p.peerInfoList))
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	p := createPeer("0")
+	other := createPeer("1")
+	p.ledger.addAccount("1", other.info.Pk)
+
+	if _, err := p.createSignedTransaction("2", 10); !errors.Is(err, ErrUnknownAccount) {
+		t.Errorf("expected %v, got %v", ErrUnknownAccount, err)
+	}
+
+	st, err := p.createSignedTransaction("1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ledger.transaction(st.Transaction); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("expected %v, got %v", ErrInsufficientFunds, err)
+	}
+
+	tr := makeTree(func(*node) {}, func(*node) {})
+	if _, err := tr.insert(2, nil, 1, []byte("missing"), nil); !errors.Is(err, ErrUnknownParent) {
+		t.Errorf("expected %v, got %v", ErrUnknownParent, err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	before := runtime.NumGoroutine()
+	peerList := createAndConnectNPeers(t, 5)
+	randomTransactions(peerList, 100, 1000, 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	for _, p := range peerList {
+		if err := p.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	// create
+	// Goroutines outside the peers may take a moment to notice
+	waitFor(t, func() bool {
+		return runtime.NumGoroutine() <= before
+	})
+}
+
+func TestDaemon(t *testing.T) {
+	// A peer runs from the files in its data directory, keeps the key it
+	// made on its first run, and shuts down when its context is done
+	dir := t.TempDir()
+	keyFile, genesisFile := filepath.Join(dir, "key.pem"), filepath.Join(dir, "genesis.json")
+	sk, err := LoadKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadKey(keyFile)
+	if err != nil || !sk.Equal(again) {
+		t.Fatalf("expected the same key on the second run, got error %v", err)
+	}
+	if err := WriteGenesis(genesisFile, 42, []string{EncodeKey(sk.PublicKey)}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPeer("daemon", sk)
+	if err := p.UseGenesis(genesisFile); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := p.Start(ctx, "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.Status(); s.Alias != "daemon" || s.ChainLength != 0 {
+		t.Errorf("unexpected status %+v", s)
+	}
+
+	cancel()
+	select {
+	case <-p.closed:
+	case <-time.After(waitTimeout):
+		t.Fatal("timed out waiting for the peer to shut down")
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "peer1.rec")
+	peerList := createNPeers(5)
+	recorded := peerList[1]
+	if err := recorded.Record(file); err != nil {
+		t.Fatal(err)
+	}
+	connectPeers(t, peerList)
+
+	for i := 0; i < 5; i++ {
+		randomTransactions(peerList, 100, 1000, 5)
+		time.Sleep(time.Second)
+	}
+	for _, p := range peerList {
+		p.Close()
+	}
+
+	replayed := createPeer("1")
+	if err := replayed.Replay(file); err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.Close()
+
+	if !bytes.Equal(replayed.tree.current.hash(), recorded.tree.current.hash()) {
+		recorded.PrintTree()
+		replayed.PrintTree()
+		t.Error("replayed peer is on another block")
+	}
+	for _, p := range peerList {
+		if replayed.ledger.getBalance(p.info.Pk) != recorded.ledger.getBalance(p.info.Pk) {
+			t.Errorf("balance of %s differs after replay", p.info.Alias)
+		}
+	}
+}
+
+func TestOwnBlocksKeepTheHead(t *testing.T) {
+	// Our own blocks count towards the longest chain, so a shorter branch
+	// from the network does not take the head from them
+	tr := makeTree(func(*node) {}, func(*node) {})
+	genesis := tr.current
+	tr.insertNext(1, nil, nil)
+	head := tr.insertNext(2, nil, nil)
+	tr.insert(3, nil, 0, genesis.hash(), nil)
+	if tr.current != head || tr.longest != 2 {
+		t.Errorf("expected our chain of 2 blocks to stay the head, got a chain of %d", tr.current.Length)
+	}
+}
+
+func TestTreeIndex(t *testing.T) {
+	// Blocks are found by hash, and whether one is on the chain of another
+	// agrees with searching the tree
+	tr := makeTree(func(*node) {}, func(*node) {})
+	genesis := tr.current
+	nodes := []*node{genesis, tr.insertNext(1, nil, nil), tr.insertNext(2, []string{"a"}, nil)}
+	fork, _ := tr.insert(2, []string{"b"}, 1, nodes[1].hash(), nil)
+	nodes = append(nodes, fork)
+	fork, _ = tr.insert(3, nil, 2, fork.hash(), nil)
+	nodes = append(nodes, fork)
+
+	for _, n := range nodes {
+		if tr.find(n.hash()) != n {
+			t.Errorf("expected to find the block of slot %d", n.Slot)
+		}
+		for _, n2 := range nodes {
+			if n.isAncestorOf(n2) != n.contains(n2) {
+				t.Errorf("expected isAncestorOf to agree with contains for slots %d and %d", n.Slot, n2.Slot)
+			}
+		}
+	}
+	if tr.find([]byte("unknown")) != nil {
+		t.Errorf("expected no block for an unknown hash")
+	}
+	if _, err := tr.insert(4, nil, 3, nodes[2].hash(), nil); err != ErrUnknownParent {
+		t.Errorf("expected a parent in another slot to be unknown, got %v", err)
+	}
+}
+
+func TestReverseTransaction(t *testing.T) {
+	// Undoing a transaction moves back exactly what it moved
+	p := createPeer("a")
+	to := createPeer("b")
+	p.ledger.addAccount("b", to.info.Pk)
+	p.ledger.addMoney(p.info.Pk, 100)
+	tr, _ := p.ledger.createTransaction("b", 10)
+	if err := p.ledger.transaction(*tr); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ledger.reverseTransaction(*tr); err != nil {
+		t.Fatal(err)
+	}
+	if p.ledger.getBalance(p.info.Pk) != 100 || p.ledger.getBalance(to.info.Pk) != 0 {
+		t.Errorf("expected balances 100 and 0 after reversal, got %d and %d",
+			p.ledger.getBalance(p.info.Pk), p.ledger.getBalance(to.info.Pk))
+	}
+}
+
+func TestDuplicateTransaction(t *testing.T) {
+	// A transaction in two blocks of the chain moves money once, and
+	// undoing both blocks moves it back once
+	p := createPeer("a")
+	to := createPeer("b")
+	p.ledger.addAccount("b", to.info.Pk)
+	p.ledger.addMoney(p.info.Pk, 100)
+	tr, _ := p.ledger.createTransaction("b", 10)
+	p.transactions[tr.ID] = signedTransaction{Transaction: *tr}
+	p.initializeTree()
+	genesis := p.tree.current
+
+	p.tree.insertNext(1, []string{tr.ID}, nil)
+	p.tree.insertNext(2, []string{tr.ID}, nil)
+	if p.ledger.getBalance(to.info.Pk) != 9 {
+		t.Errorf("expected the transaction to move 9 once, got %d", p.ledger.getBalance(to.info.Pk))
+	}
+
+	n, _ := p.tree.insert(3, nil, 0, genesis.hash(), nil)
+	n, _ = p.tree.insert(4, nil, 3, n.hash(), nil)
+	p.tree.insert(5, nil, 4, n.hash(), nil)
+	if p.ledger.getBalance(p.info.Pk) != 100 || p.ledger.getBalance(to.info.Pk) != 0 {
+		t.Errorf("expected balances 100 and 0 after the reorg, got %d and %d",
+			p.ledger.getBalance(p.info.Pk), p.ledger.getBalance(to.info.Pk))
+	}
+}
+
+func TestStakeAtParent(t *testing.T) {
+	// The stake is the balance at the end of the chain up to the parent,
+	// winnings included, whichever branch is the head
+	p := createPeer("a")
+	to := createPeer("b")
+	p.ledger.addAccount("b", to.info.Pk)
+	p.ledger.addMoney(p.info.Pk, 100)
+	tr, _ := p.ledger.createTransaction("b", 10)
+	p.transactions[tr.ID] = signedTransaction{Transaction: *tr}
+	p.initializeTree()
+	genesis := p.tree.current
+
+	n := p.tree.insertNext(1, []string{tr.ID}, &to.info.Pk)
+	head := p.tree.insertNext(2, nil, &to.info.Pk)
+	fork, _ := p.tree.insert(3, nil, 0, genesis.hash(), &p.info.Pk)
+	if p.tree.current != head {
+		t.Fatal("expected the longer chain to stay the head")
+	}
+
+	for _, c := range []struct {
+		n     *node
+		peer  *Peer
+		stake int
+	}{
+		{head, to, 9 + 11 + 10},
+		{n, to, 9 + 11},
+		{n, p, 91},
+		{genesis, p, 100},
+		{fork, p, 110},
+		{fork, to, 0},
+	} {
+		if stake := p.stakeAt(c.n, c.peer.info.Pk); stake != c.stake {
+			t.Errorf("expected a stake of %d for %s after slot %d, got %d", c.stake, c.peer.info.Alias, c.n.Slot, stake)
+		}
+	}
+	if p.ledger.getBalance(p.info.Pk) != 91 || p.ledger.getBalance(to.info.Pk) != 30 {
+		t.Errorf("expected the ledger of the head to be left alone, got %d and %d",
+			p.ledger.getBalance(p.info.Pk), p.ledger.getBalance(to.info.Pk))
+	}
+}
+
+func TestRemoveFromQueue(t *testing.T) {
+	p := createPeer("a")
+	for _, id := range []string{"a", "b", "c", "d"} {
+		p.addToQueue(id)
+	}
+	p.removeFromQueue("a", "c")
+	if queue := p.clearQueue(); len(queue) != 2 || queue[0] != "b" || queue[1] != "d" {
+		t.Errorf("expected [b d] left in the queue, got %v", queue)
+	}
+}
+
+func TestReleasedTransactionNotQueued(t *testing.T) {
+	// A transaction that completes a pending block is in the chain, so it is
+	// not queued for our next block, nor when it arrives again
+	p := createPeer("a")
+	winner := createPeer("b")
+	p.replaying = true // Nobody to fetch the transaction from
+	p.ledger.addAccount("b", winner.info.Pk)
+	p.ledger.addMoney(winner.info.Pk, genesisBalance)
+	winner.ledger.addAccount("a", p.info.Pk)
+	p.initializeTree()
+	p.initializeRPC()
+	p.initializeMetrics()
+	genesis := p.tree.current
+
+	var draw []byte
+	for winner.blockInfo.slot = 1; ; winner.blockInfo.slot++ {
+		draw, _ = winner.computeDraw()
+		if aboveHardness(p.computeValue(draw, winner.info.Pk, genesis)) {
+			break
+		}
+	}
+	st, _ := winner.createSignedTransaction("a", 10)
+	b := block{
+		Transactions: []string{st.Transaction.ID},
+		Pk:           &winner.info.Pk,
+		Ph:           genesis.hash(),
+		Slot:         winner.blockInfo.slot,
+		Draw:         draw,
+	}
+	b.Shb, _ = winner.sign(b.Ph, b.Transactions)
+
+	if err := p.receivedBlock(nil, b); !errors.Is(err, rpc.ErrNotForwarded) {
+		t.Fatalf("expected the block to wait for its transaction, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := p.receivedSignedTransaction(nil, *st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.tree.current.Slot != b.Slot {
+		t.Fatalf("expected the block of slot %d to be added, the head is at slot %d", b.Slot, p.tree.current.Slot)
+	}
+	if queue := p.clearQueue(); len(queue) != 0 {
+		t.Errorf("expected an empty queue, got %v", queue)
+	}
+}
+
+func TestLateJoin(t *testing.T) {
+	peerList := createNPeers(6)
+	connectPeers(t, peerList[:5])
+	defer func() {
+		for _, p := range peerList {
+			p.Close()
+		}
+	}()
+
+	// Blocks are won by chance, so we wait for a few
+	for i := 0; peerList[0].Head().Length < 3; i++ {
+		if i == 30 {
+			t.Fatal("no blocks were made")
+		}
+		randomTransactions(peerList[:5], 100, 1000, 5)
+		time.Sleep(time.Second)
+	}
+
+	head := peerList[0].Head()
+	late := peerList[5]
+	if err := late.Start(context.Background(), getAddress(5), getAddress(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	if late.blockInfo.seed != peerList[0].blockInfo.seed {
+		t.Error("late peer has another seed")
+	}
+	if _, err := late.Block(head.Hash); err != nil {
+		t.Errorf("late peer is missing the head it joined at: %v", err)
+	}
+	if late.Head().Length < head.Length {
+		t.Errorf("late peer has a chain of %d blocks, expected at least %d", late.Head().Length, head.Length)
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	peerList := createNPeers(7)
+	connectPeers(t, peerList[:5])
+	defer func() {
+		for _, p := range peerList {
+			p.Close()
+		}
+	}()
+
+	sender, receiver := peerList[0], peerList[5]
+	var head block
+	for i := 0; ; i++ {
+		if i == 30 {
+			t.Fatal("no blocks were made")
+		}
+		sender.treeMu.RLock()
+		b, ok := sender.blocks[sender.tree.current]
+		length := sender.tree.current.Length
+		sender.treeMu.RUnlock()
+		if ok && length >= 3 {
+			head = b
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	// Without syncing, so the receiver has none of the ancestors. The block
+	// comes from a peer that has none of them either, so they are asked for
+	// from the others.
+	empty := peerList[6]
+	sender.treeMu.RLock()
+	receiver.initialGenesis = sender.genesis
+	empty.initialGenesis = sender.genesis
+	sender.treeMu.RUnlock()
+	for _, i := range []int{5, 6} {
+		if err := peerList[i].Start(context.Background(), getAddress(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn, err := receiver.rpc.Dial(getAddress(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.rpc.Dial(getAddress(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// An orphan is not flooded on before it could be checked
+	if err := receiver.receivedBlock(conn, head); !errors.Is(err, rpc.ErrNotForwarded) {
+		t.Fatalf("expected the orphan not to be forwarded, got %v", err)
+	}
+	waitFor(t, func() bool {
+		receiver.treeMu.RLock()
+		defer receiver.treeMu.RUnlock()
+		return receiver.knownBlock(head)
+	})
+
+	// The pool is bounded, and gives up on orphans in time
+	pool := makeOrphanPool()
+	now := time.Now()
+	for i := 0; i <= maxOrphans; i++ {
+		b := block{Slot: i + 1, Ps: i, Ph: []byte{1}, Shb: []byte(strconv.Itoa(i))}
+		pool.add(b, now.Add(time.Duration(i)))
+	}
+	if pool.len() != maxOrphans || len(pool.take(0, []byte{1}, now)) != 0 {
+		t.Errorf("expected the oldest of %d orphans to go", pool.len())
+	}
+	if len(pool.take(1, []byte{1}, now.Add(orphanExpiry+time.Second))) != 0 || pool.len() != 0 {
+		t.Error("orphans did not expire")
+	}
+
+	// A parent is asked for once at a time, and again once the asking failed
+	b := block{Slot: 2, Ps: 1, Ph: []byte{2}, Shb: []byte("a")}
+	other := block{Slot: 3, Ps: 1, Ph: []byte{2}, Shb: []byte("b")}
+	if !pool.add(b, now) || pool.add(other, now) {
+		t.Error("expected the parent to be asked for once")
+	}
+	pool.fetched(1, []byte{2})
+	if !pool.add(other, now) {
+		t.Error("expected the parent to be asked for again")
+	}
+}
+
+func TestMissingTransactions(t *testing.T) {
+	peerList := createNPeers(6)
+	connectPeers(t, peerList[:5])
+	defer func() {
+		for _, p := range peerList {
+			p.Close()
+		}
+	}()
+
+	// The blocks from the genesis to the first one with transactions
+	sender, receiver := peerList[0], peerList[5]
+	var chain []block
+	for i := 0; chain == nil; i++ {
+		if i == 30 {
+			t.Fatal("no blocks with transactions were made")
+		}
+		if _, err := sender.SendTransaction("1", 10); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Second)
+
+		sender.treeMu.RLock()
+		var path []block
+		for n := sender.tree.current; n.parent != nil; n = n.parent {
+			path = append([]block{sender.blocks[n]}, path...)
+		}
+		for j, b := range path {
+			if len(b.Transactions) > 0 {
+				chain = path[:j+1]
+				break
+			}
+		}
+		sender.treeMu.RUnlock()
+	}
+
+	sender.treeMu.RLock()
+	receiver.initialGenesis = sender.genesis
+	sender.treeMu.RUnlock()
+	if err := receiver.Start(context.Background(), getAddress(5)); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := receiver.rpc.Dial(getAddress(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transactions were flooded before the receiver joined, so it only
+	// gets them by asking. Held blocks are not flooded on meanwhile.
+	for _, b := range chain {
+		if err := receiver.receivedBlock(conn, b); err != nil && !errors.Is(err, rpc.ErrNotForwarded) {
+			t.Fatal(err)
+		}
+	}
+	last := chain[len(chain)-1]
+	waitFor(t, func() bool {
+		receiver.treeMu.RLock()
+		defer receiver.treeMu.RUnlock()
+		return receiver.knownBlock(last)
+	})
+	if missing := receiver.missingTransactions(last.Transactions); len(missing) != 0 {
+		t.Errorf("block added without transactions %v", missing)
+	}
+	if receiver.pending.len() != 0 {
+		t.Errorf("%d blocks still pending", receiver.pending.len())
+	}
+
+	// The pool is bounded, and gives up on blocks in time
+	pool := &pendingPool{}
+	now := time.Now()
+	pool.mu.Lock()
+	for i := 0; i <= maxPendingBlocks; i++ {
+		b := block{Slot: i + 1, Shb: []byte(strconv.Itoa(i))}
+		pool.add(nil, b, []string{"a", strconv.Itoa(i)}, now.Add(time.Duration(i)))
+	}
+	pool.mu.Unlock()
+	if pool.len() != maxPendingBlocks || len(pool.arrived("0", now)) != 0 {
+		t.Errorf("expected the oldest of %d pending blocks to go", pool.len())
+	}
+	pool.arrived("1", now)
+	if complete := pool.arrived("a", now); len(complete) != 1 || complete[0].block.Slot != 2 {
+		t.Errorf("expected only the block of slot 2 to be complete, got %d blocks", len(complete))
+	}
+	if len(pool.arrived("3", now.Add(pendingExpiry+time.Second))) != 0 || pool.len() != 0 {
+		t.Error("pending blocks did not expire")
+	}
+}
+
+func TestWalletAPI(t *testing.T) {
+	peerList := createAndConnectNPeers(t, 3)
+	defer func() {
+		for _, p := range peerList {
+			p.Close()
+		}
+	}()
+	server := httptest.NewServer(peerList[0].apiHandler("secret"))
+	defer server.Close()
+
+	res := apiRequest(t, http.MethodPost, server.URL+"/send", `{"To": "1", "Amount": 100}`, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", "application/json")
+	})
+	var sent TransactionStatus
+	json.NewDecoder(res.Body).Decode(&sent)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || sent.To != "1" || sent.State != Pending {
+		t.Fatalf("unexpected answer to send: %d %+v", res.StatusCode, sent)
+	}
+
+	waitFor(t, func() bool {
+		status, err := peerList[1].Transaction(sent.ID)
+		return err == nil && status.From == "0"
+	})
+	if history := peerList[1].History(); len(history) != 1 || history[0].ID != sent.ID {
+		t.Errorf("unexpected history: %+v", history)
+	}
+
+	for path, code := range map[string]int{
+		"/transactions/missing": http.StatusNotFound,
+		"/balance?account=nope": http.StatusNotFound,
+		"/balance?account=1":    http.StatusOK,
+		"/send":                 http.StatusMethodNotAllowed,
+	} {
+		res := apiRequest(t, http.MethodGet, server.URL+path, "", func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer secret")
+		})
+		res.Body.Close()
+		if res.StatusCode != code {
+			t.Errorf("GET %s: expected %d, got %d", path, code, res.StatusCode)
+		}
+	}
+
+	// What a page in a browser could send, or a process without the token
+	for name, c := range map[string]struct {
+		header func(req *http.Request)
+		code   int
+	}{
+		"no token": {func(req *http.Request) {
+			req.Header.Set("Content-Type", "application/json")
+		}, http.StatusUnauthorized},
+		"plain text": {func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer secret")
+			req.Header.Set("Content-Type", "text/plain")
+		}, http.StatusUnsupportedMediaType},
+		"cross origin": {func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer secret")
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Origin", "http://example.com")
+		}, http.StatusForbidden},
+		"other host": {func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer secret")
+			req.Header.Set("Content-Type", "application/json")
+			req.Host = "example.com"
+		}, http.StatusForbidden},
+	} {
+		res := apiRequest(t, http.MethodPost, server.URL+"/send", `{"To": "1", "Amount": 100}`, c.header)
+		res.Body.Close()
+		if res.StatusCode != c.code {
+			t.Errorf("%s: expected %d, got %d", name, c.code, res.StatusCode)
+		}
+	}
+}
+
+func TestNodeAPI(t *testing.T) {
+	peerList := createAndConnectNPeers(t, 3)
+	defer func() {
+		for _, p := range peerList {
+			p.Close()
+		}
+	}()
+	server := httptest.NewServer(peerList[0].apiHandler(""))
+	defer server.Close()
+
+	st := SignedTransaction{
+		ID:     "signed-elsewhere",
+		From:   EncodeKey(peerList[1].info.Pk),
+		To:     EncodeKey(peerList[2].info.Pk),
+		Amount: 50,
+	}
+	if err := st.Sign(peerList[1].sk); err != nil {
+		t.Fatal(err)
+	}
+	forged := st
+	forged.ID = "forged"
+	forged.Amount = 5000
+
+	for _, submit := range []struct {
+		st   SignedTransaction
+		code int
+	}{
+		{st, http.StatusOK},
+		{st, http.StatusConflict},
+		{forged, http.StatusBadRequest},
+	} {
+		b, _ := json.Marshal(submit.st)
+		res, err := http.Post(server.URL+"/transactions", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != submit.code {
+			t.Errorf("submitting %s: expected %d, got %d", submit.st.ID, submit.code, res.StatusCode)
+		}
+	}
+	waitFor(t, func() bool {
+		_, err := peerList[2].Transaction(st.ID)
+		return err == nil
+	})
+
+	var head Block
+	if code := getJSON(t, server.URL+"/head", &head); code != http.StatusOK || !head.InChain {
+		t.Errorf("unexpected head: %d %+v", code, head)
+	}
+	var blocks []Block
+	if code := getJSON(t, server.URL+"/blocks?slot=0", &blocks); code != http.StatusOK || len(blocks) != 1 || blocks[0].Parent != "" {
+		t.Errorf("unexpected genesis: %d %+v", code, blocks)
+	}
+	var block Block
+	if code := getJSON(t, server.URL+"/blocks/"+head.Hash, &block); code != http.StatusOK || block.Hash != head.Hash {
+		t.Errorf("unexpected block: %d %+v", code, block)
+	}
+	if code := getJSON(t, server.URL+"/blocks/00", &block); code != http.StatusNotFound {
+		t.Errorf("expected %d for an unknown block, got %d", http.StatusNotFound, code)
+	}
+	var peers []PeerInfo
+	if getJSON(t, server.URL+"/peers", &peers); len(peers) != 3 {
+		t.Errorf("expected 3 peers, got %+v", peers)
+	}
+	var balances []Balance
+	if getJSON(t, server.URL+"/balances", &balances); len(balances) != 3 {
+		t.Errorf("expected 3 balances, got %+v", balances)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	peerList := createAndConnectNPeers(t, 3)
+	events, cancel := peerList[0].Subscribe()
+	defer cancel()
+	server := httptest.NewServer(peerList[0].apiHandler(""))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	id, err := peerList[1].SendTransaction("0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(waitTimeout)
+	for received := false; !received; {
+		select {
+		case e := <-events:
+			received = e.Kind == TransactionReceived && e.Transaction.ID == id
+		case <-timeout:
+			t.Fatal("timed out waiting for the event")
+		}
+	}
+
+	reader := bufio.NewReader(res.Body)
+	line, err := reader.ReadString('\n')
+	for err == nil && line != "event: "+string(TransactionReceived)+"\n" {
+		line, err = reader.ReadString('\n')
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range peerList {
+		p.Close()
+	}
+	if _, ok := <-events; ok {
+		for range events {
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	// The metrics of the rpc and of the chain are served together
+	peerList := createAndConnectNPeers(t, 3)
+	defer func() {
+		for _, p := range peerList {
+			p.Close()
+		}
+	}()
+	if err := peerList[0].ServeMetrics("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := peerList[1].SendTransaction("0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, err := peerList[0].Transaction(id)
+		return err == nil
+	})
+
+	res, err := http.Get("http://" + peerList[0].metricsListener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"dsys_slot ",
+		"dsys_chain_length ",
+		"dsys_mempool_size ",
+		`dsys_rpc_messages_total{function="transaction",direction="received"} `,
+		"dsys_rpc_connections 2",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected the metrics to contain %q", want)
+		}
+	}
+}
+
+func TestReorgDepth(t *testing.T) {
+	// Switching from a chain of two blocks to a fork of three undoes two
+	tr := makeTree(func(*node) {}, func(*node) {})
+	genesis := tr.current
+	tr.insertNext(1, nil, nil)
+	head := tr.insertNext(2, nil, nil)
+	fork, _ := tr.insert(3, nil, 0, genesis.hash(), nil)
+	fork, _ = tr.insert(4, nil, 3, fork.hash(), nil)
+	fork, _ = tr.insert(5, nil, 4, fork.hash(), nil)
+	if tr.current != fork || head.contains(fork) || tr.reorgDepth != 2 {
+		t.Errorf("expected a reorg of depth 2, got %d", tr.reorgDepth)
+	}
+}
+
+// Sends a request to the API, with the headers set by header.
+func apiRequest(t *testing.T, method string, url string, body string, header func(req *http.Request)) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header(req)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// Decodes the answer to a GET into v and returns its status code.
+func getJSON(t *testing.T, url string, v interface{}) int {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	json.NewDecoder(res.Body).Decode(v)
+	return res.StatusCode
+}
+
+// Creates n peers on an in-memory network and waits until they all know each
+// other and have received the genesis.
+func createAndConnectNPeers(t *testing.T, n int) []*Peer {
+	peerList := createNPeers(n)
+	connectPeers(t, peerList)
+	return peerList
+}
+
+// Creates n peers on an in-memory network without starting them.
+func createNPeers(n int) []*Peer {
+	network := rpc.NewNetwork(networkSeed)
+	peerList := []*Peer{}
 	for i := 0; i < n; i++ {
-		peerList = append(peerList, createPeer(strconv.Itoa(i)))
+		p := createPeer(strconv.Itoa(i))
+		p.transport = network.Host(getAddress(i))
+		peerList = append(peerList, p)
 	}
+	return peerList
+}
 
-	// connect
+// Starts the peers and waits until they all know each other and have
+// received the genesis.
+func connectPeers(t *testing.T, peerList []*Peer) {
+	n := len(peerList)
 	for i, p := range peerList {
-		if i == 0 {
-			p.ConnectAndListen("", getAddress(port))
-		} else {
-			p.ConnectAndListen(getAddress(rand.Intn(i)+port), getAddress(port+i))
-			time.Sleep(time.Duration(100*i/10+1) * time.Millisecond) // presence needs to be sent around
+		bootstrap := []string{}
+		if i > 0 {
+			bootstrap = append(bootstrap, getAddress(rand.Intn(i)))
+		}
+		if err := p.Start(context.Background(), getAddress(i), bootstrap...); err != nil {
+			t.Fatal(err)
 		}
 	}
 
+	waitFor(t, func() bool {
+		for _, p := range peerList {
+			p.peerInfoListMu.Lock()
+			known := len(p.peerInfoList)
+			p.peerInfoListMu.Unlock()
+			if known < n {
+				return false
+			}
+		}
+		return true
+	})
+
 	peerList[0].SendGenesis(peerList...)
-	time.Sleep(time.Duration(100*n/10+1) * time.Millisecond)
 
-	return peerList
+	waitFor(t, func() bool {
+		for _, p := range peerList {
+			if p.ledger.getBalance(peerList[0].info.Pk) == 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func getAddress(i int) string {
+	return "peer" + strconv.Itoa(i)
 }
 
-func getAddress(port int) string {
-	return ":" + strings.TrimSpace(strconv.Itoa(port))
+// Waits until the condition holds, and fails the test if it takes too long.
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(waitTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the network")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
 
-func randomTransactions(peerList []*peer, min int, max int, count int) {
+func randomTransactions(peerList []*Peer, min int, max int, count int) {
 	for i := 0; i < count; i++ {
 		from := rand.Intn(len(peerList))
 		to := strconv.Itoa(rand.Intn(len(peerList)))
@@ -117,10 +1027,14 @@ func randomTransactions(peerList []*peer, min int, max int, count int) {
 	}
 }
 
-func checkAgreement(peerList []*peer) bool {
+func checkAgreement(peerList []*Peer) bool {
+	first := make(map[string]int)
+	for _, b := range peerList[0].Balances() {
+		first[b.Account] = b.Balance
+	}
 	for _, p := range peerList {
-		for k, v := range p.ledger.Accounts {
-			if v != peerList[0].ledger.Accounts[k] {
+		for _, b := range p.Balances() {
+			if b.Balance != first[b.Account] {
 				fmt.Println("bad ledger:", p.info.Alias)
 				return false
 			}
@@ -129,13 +1043,13 @@ func checkAgreement(peerList []*peer) bool {
 	return true
 }
 
-func printAccounts(peerList []*peer) {
+func printAccounts(peerList []*Peer) {
 	for _, p := range peerList {
 		p.ledger.printAccounts()
 	}
 }
 
-func printTrees(peerList []*peer) {
+func printTrees(peerList []*Peer) {
 	for _, p := range peerList {
 		p.PrintTree()
 	}
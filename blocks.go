@@ -1,8 +1,9 @@
-package main
+package dsys
 
 import (
 	"crypto/rsa"
 	"crypto/sha256"
+	"fmt"
 	"math/big"
 	"time"
 )
@@ -17,6 +18,9 @@ type genesis struct {
 	Seed int
 }
 
+// The money each account of the genesis starts with
+const genesisBalance = 1000000
+
 type block struct {
 	Transactions []string
 	Pk           *rsa.PublicKey
@@ -27,25 +31,57 @@ type block struct {
 	Shb          []byte
 }
 
-func (p *peer) startSendingBlocks() {
+func (p *Peer) startSendingBlocks() {
+	select {
+	case <-p.closed:
+		return
+	case <-p.initializing:
+	}
+
+	ticker := time.NewTicker(slotDuration)
+	defer ticker.Stop()
+
 	for {
+		p.blockInfoMu.Lock()
 		p.blockInfo.slot++
-		time.Sleep(time.Second)
+		slot := p.blockInfo.slot
+		p.blockInfoMu.Unlock()
+		p.metrics.slot.Set(float64(slot))
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
 		p.nextSlot()
 	}
 }
 
-func (p *peer) nextSlot() {
-	draw := p.computeDraw()
-	value := p.computeValue(draw, p.sk.PublicKey)
-	if !aboveHardness(value) {
+// Returns the slot the slot loop is in.
+func (p *Peer) currentSlot() int {
+	p.blockInfoMu.RLock()
+	defer p.blockInfoMu.RUnlock()
+	return p.blockInfo.slot
+}
+
+func (p *Peer) nextSlot() {
+	draw, err := p.computeDraw()
+	if err != nil {
+		fmt.Printf("%s could not draw for slot %d: %v\n", p.info.Alias, p.blockInfo.slot, err)
 		return
 	}
 
-	n := p.tree.insertNext(p.blockInfo.slot, p.clearQueue())
-	if n.Slot == n.parent.Slot {
+	// A block must come after its parent, which a peer that synced the chain
+	// may have from a slot it has not reached yet, and the draw must win with
+	// our stake at the parent
+	p.treeMu.Lock()
+	head := p.tree.current
+	if head.Slot >= p.blockInfo.slot || !aboveHardness(p.computeValue(draw, p.sk.PublicKey, head)) {
+		p.treeMu.Unlock()
 		return
 	}
+	n := p.tree.insertNext(p.blockInfo.slot, p.clearQueue(), &p.sk.PublicKey)
+	p.observeTree()
+	p.blockAddedEvents(n, head)
 
 	b := block{
 		Transactions: n.Transactions,
@@ -55,77 +91,102 @@ func (p *peer) nextSlot() {
 		Slot:         p.blockInfo.slot,
 		Draw:         draw,
 	}
+	p.treeMu.Unlock()
 
-	b.Shb = p.sign(b.Ph, b.Transactions)
+	b.Shb, err = p.sign(b.Ph, b.Transactions)
+	if err != nil {
+		fmt.Printf("%s could not sign block of slot %d: %v\n", p.info.Alias, b.Slot, err)
+		return
+	}
+	p.treeMu.Lock()
+	p.blocks[n] = b
+	p.treeMu.Unlock()
 
 	p.BroadcastBlock(b)
-	p.payWinner(b)
-}
-
-func (p *peer) payWinner(b block) {
-	amount := 10 + len(b.Transactions)
-	p.ledger.addMoney(*b.Pk, amount)
+	p.metrics.blocksWon.Inc()
 }
 
-func (p *peer) computeDraw() []byte {
-	bytes := p.sign("LOTTERY", p.blockInfo.seed, p.blockInfo.slot)
-	return bytes
+func (p *Peer) computeDraw() ([]byte, error) {
+	return p.sign("LOTTERY", p.blockInfo.seed, p.blockInfo.slot)
 }
 
-func (p *peer) computeValue(draw []byte, pk rsa.PublicKey) *big.Int {
+// Returns what the draw is worth for a block after parent. treeMu must be
+// held.
+func (p *Peer) computeValue(draw []byte, pk rsa.PublicKey, parent *node) *big.Int {
 	drawHash := sha256.Sum256(draw)
 	drawHashValue := new(big.Int).SetBytes(drawHash[:])
-	a := big.NewInt(int64(p.ledger.getBalance(pk)))
+	a := big.NewInt(int64(p.stakeAt(parent, pk)))
 	return new(big.Int).Mul(drawHashValue, a)
 }
 
-func aboveHardness(value *big.Int) bool {
-	if value.Cmp(big.NewInt(0)) == 0 {
-		return false
+// Returns the stake of the account in a block after n, which is its balance
+// at the end of the chain up to n. It depends on the chain only, so every
+// peer, and a peer that syncs the chain later, judges a block the same
+// whatever branch it is on. treeMu must be held.
+func (p *Peer) stakeAt(n *node, pk rsa.PublicKey) int {
+	head := p.tree.current
+	if n == head {
+		return p.ledger.getBalance(pk)
 	}
-	v, _ := new(big.Int).SetString(value.String()[:3], 10)
-	return v.Cmp(big.NewInt(900)) == 1
-}
 
-func (p *peer) verifyBlock(b block) bool {
-	if !verifySignature(b.Pk, b.Draw, "LOTTERY", p.blockInfo.seed, b.Slot) {
-		return false
+	// Take the ledger back to where the chains meet, then forward to n
+	p.transactionsMu.RLock()
+	defer p.transactionsMu.RUnlock()
+	p.failedMu.Lock()
+	defer p.failedMu.Unlock()
+	l := p.ledger.copy()
+	ancestor := commonAncestor(head, n)
+	ignore := func(int, transaction, error) {}
+	for x := head; x != ancestor; x = x.parent {
+		p.reverseBlock(l, x, ignore)
 	}
-
-	if !verifySignature(b.Pk, b.Shb, b.Ph, b.Transactions) {
-		return false
+	path := make([]*node, 0)
+	for x := n; x != ancestor; x = x.parent {
+		path = append(path, x)
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		p.applyBlock(l, path[i], ignore)
 	}
+	return l.getBalance(pk)
+}
 
-	if !aboveHardness(p.computeValue(b.Draw, *b.Pk)) {
+func aboveHardness(value *big.Int) bool {
+	if value.Cmp(big.NewInt(0)) == 0 {
 		return false
 	}
+	v, _ := new(big.Int).SetString(value.String()[:3], 10)
+	return v.Cmp(big.NewInt(900)) == 1
+}
 
-	return true
+// Returns whether the draw of the block is the winner's. Whether it won
+// depends on the parent, so addBlock checks that.
+func (p *Peer) verifyDraw(b block) bool {
+	return verifySignature(b.Pk, b.Draw, "LOTTERY", p.blockInfo.seed, b.Slot)
 }
 
-func (p *peer) addToQueue(id string) {
+func (p *Peer) addToQueue(id string) {
 	p.transactionsQueueMu.Lock()
 	defer p.transactionsQueueMu.Unlock()
 	p.transactionsQueue = append(p.transactionsQueue, id)
 }
 
-func (p *peer) removeFromQueue(ids ...string) {
+func (p *Peer) removeFromQueue(ids ...string) {
 	p.transactionsQueueMu.Lock()
 	defer p.transactionsQueueMu.Unlock()
-	for _, t1 := range ids {
-		for i, t2 := range p.transactionsQueue {
-			if t1 == t2 {
-				if i == len(p.transactionsQueue)-1 {
-					p.transactionsQueue = p.transactionsQueue[:i]
-				} else {
-					p.transactionsQueue[i] = p.transactionsQueue[len(p.transactionsQueue)-1]
-				}
-			}
+	removed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		removed[id] = true
+	}
+	kept := p.transactionsQueue[:0]
+	for _, id := range p.transactionsQueue {
+		if !removed[id] {
+			kept = append(kept, id)
 		}
 	}
+	p.transactionsQueue = kept
 }
 
-func (p *peer) clearQueue() []string {
+func (p *Peer) clearQueue() []string {
 	p.transactionsQueueMu.Lock()
 	defer p.transactionsQueueMu.Unlock()
 	temp := p.transactionsQueue
@@ -133,18 +194,82 @@ func (p *peer) clearQueue() []string {
 	return temp
 }
 
-func (p *peer) runBlock(n *node) {
+// The transaction at the index of the block. A transaction may be in more
+// than one block, or more than once in a block, and fail in some of them only.
+type blockTransaction struct {
+	n *node
+	i int
+}
+
+func (p *Peer) runBlock(n *node) {
 	p.transactionsMu.RLock()
 	defer p.transactionsMu.RUnlock()
-	for _, s := range n.Transactions {
-		p.ledger.transaction(p.transactions[s])
-	}
+	p.failedMu.Lock()
+	defer p.failedMu.Unlock()
+	p.applyBlock(p.ledger, n, func(i int, t transaction, err error) {
+		if err != nil {
+			fmt.Printf("%s rejected transaction %s: %v\n", p.info.Alias, n.Transactions[i], err)
+			p.failed[blockTransaction{n, i}] = err
+			return
+		}
+		p.transactionEvent(TransactionApplied, t)
+	})
 }
 
-func (p *peer) undoBlock(n *node) {
+func (p *Peer) undoBlock(n *node) {
 	p.transactionsMu.RLock()
 	defer p.transactionsMu.RUnlock()
-	for _, s := range n.Transactions {
-		p.ledger.reverseTransaction(p.transactions[s])
+	p.failedMu.Lock()
+	defer p.failedMu.Unlock()
+	p.reverseBlock(p.ledger, n, func(i int, t transaction, err error) {
+		if err != nil {
+			fmt.Printf("%s could not reverse transaction %s: %v\n", p.info.Alias, n.Transactions[i], err)
+			return
+		}
+		p.transactionEvent(TransactionReverted, t)
+	})
+	for i := range n.Transactions {
+		delete(p.failed, blockTransaction{n, i})
 	}
 }
+
+// Applies the transactions of the block to the ledger and pays the winner,
+// calling done with the outcome of each transaction. transactionsMu must be
+// held.
+func (p *Peer) applyBlock(l *Ledger, n *node, done func(i int, t transaction, err error)) {
+	for i, s := range n.Transactions {
+		// Blocks are held until we have their transactions, so this is only
+		// a safeguard against applying a zero transaction
+		st, ok := p.transactions[s]
+		if !ok {
+			done(i, transaction{ID: s}, ErrUnknownTransaction)
+			continue
+		}
+		done(i, st.Transaction, l.transaction(st.Transaction))
+	}
+	if n.Winner != nil {
+		l.addMoney(*n.Winner, blockReward(n))
+	}
+}
+
+// Takes back what applyBlock did, last first, calling done with the outcome
+// of each transaction. transactionsMu and failedMu must be held, and the
+// failures of the block not yet forgotten.
+func (p *Peer) reverseBlock(l *Ledger, n *node, done func(i int, t transaction, err error)) {
+	if n.Winner != nil {
+		l.addMoney(*n.Winner, -blockReward(n))
+	}
+	for i := len(n.Transactions) - 1; i >= 0; i-- {
+		// Nothing was moved for a transaction the ledger rejected
+		if _, ok := p.failed[blockTransaction{n, i}]; ok {
+			continue
+		}
+		t := p.transactions[n.Transactions[i]].Transaction
+		done(i, t, l.reverseTransaction(t))
+	}
+}
+
+// The money the winner of the block is paid
+func blockReward(n *node) int {
+	return 10 + len(n.Transactions)
+}
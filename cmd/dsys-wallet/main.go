@@ -0,0 +1,341 @@
+// Command dsys-wallet sends money and checks balances through the API of a
+// running dsysd, and shows and lifts the bans of the peers it refuses.
+//
+//	dsys-wallet balance [ACCOUNT]
+//	dsys-wallet send ACCOUNT AMOUNT
+//	dsys-wallet history
+//	dsys-wallet status TXID
+//	dsys-wallet keys generate|import FILE|export
+//	dsys-wallet bans
+//	dsys-wallet unban PEER|all
+//
+// Accounts are given by their alias or key. The keys commands work on the key
+// file of the node, which uses a new key once it is restarted. The API is used
+// with the token the node keeps in its data directory.
+package main
+
+import (
+	"bytes"
+	"dsys"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// How long to wait for the node to answer
+const requestTimeout = 10 * time.Second
+
+// Accounts are shown with this many characters of their key
+const shortKey = 12
+
+type wallet struct {
+	api       string
+	tokenFile string
+	keyFile   string
+	json      bool
+	client    *http.Client
+}
+
+func main() {
+	w := wallet{client: &http.Client{Timeout: requestTimeout}}
+	flags := flag.NewFlagSet("dsys-wallet", flag.ExitOnError)
+	flags.StringVar(&w.api, "api", dsys.DefaultAPIAddress, "address of the API of the node")
+	flags.StringVar(&w.tokenFile, "token", filepath.Join("dsys-data", "api-token"), "file of the API token of the node")
+	flags.StringVar(&w.keyFile, "key", filepath.Join("dsys-data", "key.pem"), "key file of the node")
+	flags.BoolVar(&w.json, "json", false, "print JSON instead of text")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: dsys-wallet [flags] balance [ACCOUNT] | send ACCOUNT AMOUNT | history | status TXID | keys generate|import FILE|export | bans | unban PEER|all")
+		flags.PrintDefaults()
+	}
+
+	args := parseArgs(flags, os.Args[1:])
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := w.run(args[0], args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "dsys-wallet:", err)
+		os.Exit(1)
+	}
+}
+
+// Parses the flags wherever they are among the arguments, so they can also
+// follow the command. Returns the other arguments.
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func (w wallet) run(command string, args []string) error {
+	switch {
+	case command == "balance" && len(args) <= 1:
+		query := url.Values{}
+		if len(args) == 1 {
+			query.Set("account", args[0])
+		}
+		var balance dsys.Balance
+		if err := w.get("/balance?"+query.Encode(), &balance); err != nil {
+			return err
+		}
+		return w.print(balance, func() {
+			fmt.Printf("%s: %d\n", name(balance.Alias, balance.Account), balance.Balance)
+		})
+
+	case command == "send" && len(args) == 2:
+		amount, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("amount %q is not a whole number", args[1])
+		}
+		var status dsys.TransactionStatus
+		if err := w.post("/send", dsys.SendRequest{To: args[0], Amount: amount}, &status); err != nil {
+			return err
+		}
+		return w.print(status, func() {
+			fmt.Printf("Sent %d to %s in transaction %s (%s)\n", status.Amount, short(status.To), status.ID, status.State)
+		})
+
+	case command == "history" && len(args) == 0:
+		var history []dsys.TransactionStatus
+		if err := w.get("/history", &history); err != nil {
+			return err
+		}
+		return w.print(history, func() {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tSTATE\tSLOT\tFROM\tTO\tAMOUNT")
+			for _, s := range history {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", s.ID, s.State, slot(s), short(s.From), short(s.To), s.Amount)
+			}
+			tw.Flush()
+		})
+
+	case command == "status" && len(args) == 1:
+		var status dsys.TransactionStatus
+		if err := w.get("/transactions/"+url.PathEscape(args[0]), &status); err != nil {
+			return err
+		}
+		return w.print(status, func() {
+			fmt.Printf("Transaction %s: %d from %s to %s\n", status.ID, status.Amount, short(status.From), short(status.To))
+			fmt.Printf("State: %s\n", status.State)
+			if status.Slot != 0 {
+				fmt.Printf("Block: slot %d, %d confirmations\n", status.Slot, status.Confirmations)
+			}
+			if status.Error != "" {
+				fmt.Printf("Error: %s\n", status.Error)
+			}
+		})
+
+	case command == "keys" && len(args) >= 1:
+		return w.keys(args[0], args[1:])
+
+	case command == "bans" && len(args) == 0, command == "unban" && len(args) == 1:
+		var bans []dsys.Ban
+		var err error
+		switch {
+		case command == "bans":
+			err = w.get("/bans", &bans)
+		case args[0] == "all":
+			err = w.delete("/bans", &bans)
+		default:
+			err = w.delete("/bans/"+url.PathEscape(args[0]), &bans)
+		}
+		if err != nil {
+			return err
+		}
+		return w.print(bans, func() {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "PEER\tUNTIL\tREASON")
+			for _, b := range bans {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", b.Peer, b.Until.Format(time.RFC3339), b.Reason)
+			}
+			tw.Flush()
+		})
+	}
+	return fmt.Errorf("unknown command or wrong arguments: %s %v", command, args)
+}
+
+// A key as printed by the keys commands.
+type keyInfo struct {
+	File    string
+	Account string
+	Key     string `json:",omitempty"` // The private key in PEM, when exported
+}
+
+func (w wallet) keys(command string, args []string) error {
+	_, err := os.Stat(w.keyFile)
+	exists := err == nil
+
+	switch {
+	case command == "generate" && len(args) == 0:
+		if exists {
+			return fmt.Errorf("%s already exists", w.keyFile)
+		}
+		if err := os.MkdirAll(filepath.Dir(w.keyFile), 0700); err != nil {
+			return err
+		}
+		return w.printKey(false)
+
+	case command == "import" && len(args) == 1:
+		if exists {
+			return fmt.Errorf("%s already exists", w.keyFile)
+		}
+		// LoadKey would make a new key rather than fail on a missing file
+		if _, err := os.Stat(args[0]); err != nil {
+			return err
+		}
+		if _, err := dsys.LoadKey(args[0]); err != nil {
+			return err
+		}
+		b, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(w.keyFile), 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(w.keyFile, b, 0600); err != nil {
+			return err
+		}
+		return w.printKey(false)
+
+	case command == "export" && len(args) == 0:
+		if !exists {
+			return fmt.Errorf("%s does not exist: %w", w.keyFile, fs.ErrNotExist)
+		}
+		return w.printKey(true)
+	}
+	return fmt.Errorf("unknown command or wrong arguments: keys %s %v", command, args)
+}
+
+// Prints the account of the key file, and the private key if asked to. The
+// key is generated if the file does not exist.
+func (w wallet) printKey(private bool) error {
+	sk, err := dsys.LoadKey(w.keyFile)
+	if err != nil {
+		return err
+	}
+	info := keyInfo{File: w.keyFile, Account: dsys.EncodeKey(sk.PublicKey)}
+	if private {
+		b, err := os.ReadFile(w.keyFile)
+		if err != nil {
+			return err
+		}
+		info.Key = string(b)
+	}
+
+	return w.print(info, func() {
+		if private {
+			fmt.Print(info.Key)
+			return
+		}
+		fmt.Printf("Key file: %s\nAccount: %s\n", info.File, info.Account)
+	})
+}
+
+func (w wallet) get(path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, "http://"+w.api+path, nil)
+	if err != nil {
+		return err
+	}
+	return w.do(req, v)
+}
+
+func (w wallet) delete(path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodDelete, "http://"+w.api+path, nil)
+	if err != nil {
+		return err
+	}
+	return w.do(req, v)
+}
+
+func (w wallet) post(path string, body interface{}, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+w.api+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return w.do(req, v)
+}
+
+// Sends the request with the API token of the node.
+func (w wallet) do(req *http.Request, v interface{}) error {
+	token, err := os.ReadFile(w.tokenFile)
+	if err != nil {
+		return fmt.Errorf("reading the API token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	return decode(res, v)
+}
+
+// Decodes the answer into v, or returns the error the node answered with.
+func decode(res *http.Response, v interface{}) error {
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var apiErr dsys.APIError
+		if err := json.NewDecoder(res.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			return errors.New(res.Status)
+		}
+		return errors.New(apiErr.Error)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Prints v as JSON if asked to, and as text otherwise.
+func (w wallet) print(v interface{}, text func()) error {
+	if !w.json {
+		text()
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// Returns the alias of an account, or its key if it has none.
+func name(alias string, account string) string {
+	if alias != "" {
+		return alias
+	}
+	return short(account)
+}
+
+// Shortens keys, which are hundreds of digits long.
+func short(account string) string {
+	if len(account) <= shortKey {
+		return account
+	}
+	return account[:shortKey] + "..."
+}
+
+func slot(s dsys.TransactionStatus) string {
+	if s.Slot == 0 {
+		return "-"
+	}
+	return strconv.Itoa(s.Slot)
+}
@@ -0,0 +1,233 @@
+// Command dsysd runs a peer of a dsys network.
+//
+// The key of the peer is kept in the data directory unless -key is given, and
+// is generated on the first run. A network is started from a genesis file
+// that every peer of it uses, written with -new-genesis from the keys the
+// peers print with -pk:
+//
+//	dsysd -pk
+//	dsysd -new-genesis genesis.json -seed 42 KEY...
+//	dsysd -listen :4000 -genesis genesis.json
+//	dsysd -listen :4001 -genesis genesis.json -bootstrap host:4000
+//
+// The API requires the token in api-token in the data directory, which is
+// generated on the first run, so only those who can read it can use the API.
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"dsys"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How long the peer gets to shut down after a signal
+const shutdownTimeout = 10 * time.Second
+
+type config struct {
+	alias     string
+	listen    string
+	bootstrap []string
+	dataDir   string
+	keyFile   string
+	genesis   string
+	metrics   string
+	api       string
+	apiToken  string
+	record    string
+	status    time.Duration
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags)
+
+	var c config
+	var bootstrap string
+	var printKey bool
+	var newGenesis, replay string
+	var seed int
+	flag.StringVar(&c.alias, "alias", "", "name of the account of the peer (default the host name)")
+	flag.StringVar(&c.listen, "listen", ":0", "address to listen on")
+	flag.StringVar(&bootstrap, "bootstrap", "", "comma separated addresses of peers to join the network through")
+	flag.StringVar(&c.dataDir, "data", "dsys-data", "directory the key and genesis are kept in")
+	flag.StringVar(&c.keyFile, "key", "", "PEM file of the private key (default key.pem in the data directory)")
+	flag.StringVar(&c.genesis, "genesis", "", "genesis file to start the chain from (default genesis.json in the data directory, if there is one)")
+	flag.StringVar(&c.metrics, "metrics", "", "address to serve Prometheus metrics on")
+	flag.StringVar(&c.api, "api", dsys.DefaultAPIAddress, "address to serve the JSON API on, empty for none")
+	flag.StringVar(&c.apiToken, "api-token", "", "file of the token the API requires (default api-token in the data directory)")
+	flag.StringVar(&c.record, "record", "", "file to record every frame sent and received to")
+	flag.DurationVar(&c.status, "status", 10*time.Second, "how often to log the status of the peer, 0 for never")
+	flag.BoolVar(&printKey, "pk", false, "print the public key of the peer and exit")
+	flag.StringVar(&newGenesis, "new-genesis", "", "write a genesis for the keys given as arguments to the file and exit")
+	flag.IntVar(&seed, "seed", 0, "seed of the genesis written with -new-genesis")
+	flag.StringVar(&replay, "replay", "", "replay a recording into a fresh peer, print its state and exit")
+	flag.Parse()
+
+	if bootstrap != "" {
+		c.bootstrap = strings.Split(bootstrap, ",")
+	}
+	if c.alias == "" {
+		c.alias, _ = os.Hostname()
+	}
+	if c.keyFile == "" {
+		c.keyFile = filepath.Join(c.dataDir, "key.pem")
+	}
+	if c.apiToken == "" {
+		c.apiToken = filepath.Join(c.dataDir, "api-token")
+	}
+	if c.genesis == "" {
+		if _, err := os.Stat(filepath.Join(c.dataDir, "genesis.json")); err == nil {
+			c.genesis = filepath.Join(c.dataDir, "genesis.json")
+		}
+	}
+
+	var err error
+	switch {
+	case newGenesis != "":
+		err = dsys.WriteGenesis(newGenesis, seed, flag.Args())
+	case printKey:
+		err = printPublicKey(c)
+	case replay != "":
+		err = runReplay(c, replay)
+	default:
+		err = run(c)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func printPublicKey(c config) error {
+	sk, err := loadKey(c)
+	if err != nil {
+		return err
+	}
+	fmt.Println(dsys.EncodeKey(sk.PublicKey))
+	return nil
+}
+
+// Runs the peer until SIGINT or SIGTERM.
+func run(c config) error {
+	sk, err := loadKey(c)
+	if err != nil {
+		return err
+	}
+
+	p := dsys.NewPeer(c.alias, sk)
+	if c.genesis != "" {
+		if err := p.UseGenesis(c.genesis); err != nil {
+			return err
+		}
+	}
+	if c.record != "" {
+		if err := p.Record(c.record); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := p.Start(ctx, c.listen, c.bootstrap...); err != nil {
+		return err
+	}
+	if c.metrics != "" {
+		if err := p.ServeMetrics(c.metrics); err != nil {
+			p.Close()
+			return err
+		}
+	}
+	if c.api != "" {
+		if err := serveAPI(p, c); err != nil {
+			p.Close()
+			return err
+		}
+	}
+
+	status := p.Status()
+	log.Printf("%s is running on %s with %d connections", status.Alias, status.Address, status.Connections)
+	logStatus(ctx, p, c.status)
+
+	log.Printf("%s is shutting down", c.alias)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		return fmt.Errorf("shutting down: %w", err)
+	}
+	log.Printf("%s has shut down", c.alias)
+	return nil
+}
+
+// Logs the status of the peer every interval until the context is done.
+func logStatus(ctx context.Context, p *dsys.Peer, interval time.Duration) {
+	if interval <= 0 {
+		<-ctx.Done()
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s := p.Status()
+		log.Printf("slot %d, chain length %d, %d connections, %d transactions waiting", s.Slot, s.ChainLength, s.Connections, s.Mempool)
+	}
+}
+
+func runReplay(c config, file string) error {
+	sk, err := loadKey(c)
+	if err != nil {
+		return err
+	}
+
+	p := dsys.NewPeer(c.alias, sk)
+	if c.genesis != "" {
+		if err := p.UseGenesis(c.genesis); err != nil {
+			return err
+		}
+	}
+	defer p.Close()
+	if err := p.Replay(file); err != nil {
+		return err
+	}
+	p.PrintTree()
+	p.PrintAccounts()
+	return nil
+}
+
+// Serves the API with the token of the token file, which is made if needed.
+func serveAPI(p *dsys.Peer, c config) error {
+	if err := os.MkdirAll(filepath.Dir(c.apiToken), 0700); err != nil {
+		return err
+	}
+	token, err := dsys.LoadAPIToken(c.apiToken)
+	if err != nil {
+		return err
+	}
+	return p.ServeAPI(c.api, token)
+}
+
+// Loads the key of the peer, making the data directory for a new key if
+// needed.
+func loadKey(c config) (*rsa.PrivateKey, error) {
+	if _, err := os.Stat(c.keyFile); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(c.keyFile), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return dsys.LoadKey(c.keyFile)
+}
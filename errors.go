@@ -0,0 +1,20 @@
+package dsys
+
+import "errors"
+
+var (
+	ErrBadSignature       = errors.New("bad signature")
+	ErrBadKey             = errors.New("bad public key")
+	ErrUnknownParent      = errors.New("unknown parent block")
+	ErrInvalidDraw        = errors.New("invalid lottery draw")
+	ErrUnknownAccount     = errors.New("unknown account")
+	ErrAliasTaken         = errors.New("alias bound to another key")
+	ErrInvalidAmount      = errors.New("invalid transaction amount")
+	ErrInsufficientFunds  = errors.New("insufficient funds")
+	ErrUnknownTransaction = errors.New("unknown transaction")
+	ErrKnownTransaction   = errors.New("transaction already known")
+	ErrInvalidTransaction = errors.New("invalid transaction")
+	ErrUnknownBlock       = errors.New("unknown block")
+	ErrOtherGenesis       = errors.New("chain started from another genesis")
+	ErrNotBanned          = errors.New("peer not banned")
+)
@@ -0,0 +1,156 @@
+package dsys
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type EventKind string
+
+// The kinds of events a peer emits.
+const (
+	TransactionReceived EventKind = "transaction-received"
+	TransactionApplied  EventKind = "transaction-applied"
+	TransactionReverted EventKind = "transaction-reverted"
+	BlockReceived       EventKind = "block-received"
+	BlockAccepted       EventKind = "block-accepted"
+	BlockRejected       EventKind = "block-rejected"
+	HeadChanged         EventKind = "head-changed"
+	PeerJoined          EventKind = "peer-joined"
+)
+
+// How many events a subscriber may fall behind before it is dropped
+const eventBuffer = 256
+
+// Something that happened to a peer. Which of the fields are set depends on
+// the kind.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+
+	Transaction *TransactionInfo `json:",omitempty"`
+	Block       *Block           `json:",omitempty"` // For a received block only the slot, parent and transactions are known
+	Peer        *PeerInfo        `json:",omitempty"`
+	ReorgDepth  int              `json:",omitempty"` // Blocks undone when the head changed to another branch
+	Error       string           `json:",omitempty"` // Why a block was rejected
+}
+
+// A transaction as given in events. Accounts are given by their alias, or
+// their key if the alias is not known.
+type TransactionInfo struct {
+	ID     string
+	From   string
+	To     string
+	Amount int
+}
+
+// The subscribers to the events of a peer.
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[chan Event]bool
+	closed bool
+}
+
+func makeEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan Event]bool)}
+}
+
+// Returns the events of the peer from now on, and a function that ends the
+// subscription. The channel is closed when the subscription ends, when the
+// peer shuts down, or when the subscriber falls too far behind, so it knows
+// it missed events rather than holding up the peer.
+func (p *Peer) Subscribe() (<-chan Event, func()) {
+	h := p.events
+	c := make(chan Event, eventBuffer)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(c)
+		return c, func() {}
+	}
+	h.subs[c] = true
+
+	return c, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.drop(c)
+	}
+}
+
+func (h *eventHub) publish(e Event) {
+	e.Time = time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.subs {
+		select {
+		case c <- e:
+		default:
+			h.drop(c)
+		}
+	}
+}
+
+// Ends every subscription.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for c := range h.subs {
+		h.drop(c)
+	}
+}
+
+// mu must be held.
+func (h *eventHub) drop(c chan Event) {
+	if h.subs[c] {
+		delete(h.subs, c)
+		close(c)
+	}
+}
+
+func (p *Peer) transactionEvent(kind EventKind, t transaction) {
+	p.events.publish(Event{
+		Kind: kind,
+		Transaction: &TransactionInfo{
+			ID:     t.ID,
+			From:   p.accountName(t.From),
+			To:     p.accountName(t.To),
+			Amount: t.Amount,
+		},
+	})
+}
+
+// Emits the events of a block that was added to the tree, and of the head if
+// it moved. treeMu must be held.
+func (p *Peer) blockAddedEvents(n *node, head *node) {
+	block := p.blockOf(n)
+	p.events.publish(Event{Kind: BlockAccepted, Block: &block})
+
+	if p.tree.current != head {
+		// The head only moved to another branch if goTo undid blocks
+		depth := 0
+		if !head.isAncestorOf(p.tree.current) {
+			depth = p.tree.reorgDepth
+		}
+		block := p.blockOf(p.tree.current)
+		p.events.publish(Event{Kind: HeadChanged, Block: &block, ReorgDepth: depth})
+	}
+}
+
+func (p *Peer) blockEvent(kind EventKind, b block, err error) {
+	e := Event{
+		Kind: kind,
+		Block: &Block{
+			Slot:         b.Slot,
+			Parent:       hex.EncodeToString(b.Ph),
+			Transactions: b.Transactions,
+		},
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	p.events.publish(e)
+}
@@ -0,0 +1,54 @@
+package dsys
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// A genesis as it is kept in a file. The accounts are public keys encoded
+// with EncodeKey.
+type genesisFile struct {
+	Seed     int
+	Accounts []string
+}
+
+// Writes a genesis that starts the given accounts off with money, for peers
+// to start from with UseGenesis.
+func WriteGenesis(file string, seed int, accounts []string) error {
+	for _, account := range accounts {
+		if _, err := decodePk(account); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.MarshalIndent(genesisFile{Seed: seed, Accounts: accounts}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, b, 0644)
+}
+
+// Reads a genesis written by WriteGenesis, which the peer starts its chain
+// from when it starts instead of waiting for a genesis from the network.
+func (p *Peer) UseGenesis(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var gf genesisFile
+	if err := json.Unmarshal(b, &gf); err != nil {
+		return fmt.Errorf("genesis %s: %w", file, err)
+	}
+
+	g := genesis{Seed: gf.Seed}
+	for _, account := range gf.Accounts {
+		pk, err := decodePk(account)
+		if err != nil {
+			return fmt.Errorf("genesis %s: %w", file, err)
+		}
+		g.Pks = append(g.Pks, *pk)
+	}
+	p.initialGenesis = &g
+	return nil
+}
@@ -1,39 +1,76 @@
-package main
+package dsys
 
 import (
-	"log"
-	"net"
+	"dsys/rpc"
 )
 
-func (p *peer) initialize(listenAddress string) {
-	p.initializeListener(listenAddress)
+func (p *Peer) initialize(listenAddress string) error {
+	if err := p.initializeListener(listenAddress); err != nil {
+		return err
+	}
 	p.initializeTree()
 	p.initializeRPC()
+	p.initializeMetrics()
+
+	if p.recording != nil {
+		if err := p.rpc.SetRecorder(p.recording); err != nil {
+			p.listener.Close()
+			return err
+		}
+	}
+	return nil
 }
 
-func (p *peer) initializeListener(listenAddress string) {
-	ln, err := net.Listen("tcp", listenAddress)
+func (p *Peer) initializeListener(listenAddress string) error {
+	ln, err := p.transport.Listen(listenAddress)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	p.listener = ln
-	p.info.Address = getLocalAddress(p.listener)
+	p.info.Address = ln.Addr().String()
+	if p.transport == rpc.TCP {
+		p.info.Address, err = getLocalAddress(p.listener)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	p.info.Signature, err = p.sign(p.info.Alias, p.info.Address, p.info.Pk)
+	if err != nil {
+		ln.Close()
+		return err
+	}
 	p.addToPeerInfoList(p.info)
+	return nil
 }
 
-func (p *peer) initializeTree() {
+func (p *Peer) initializeTree() {
 	p.tree = makeTree(p.runBlock, p.undoBlock)
 }
 
-func (p *peer) initializeRPC() {
+func (p *Peer) initializeRPC() {
 	p.rpc = p.makeRpc()
 }
 
-func (p *peer) initializeGenesis(g genesis) {
-	p.blockInfo.seed = g.Seed
-	for _, pk := range g.Pks {
-		p.ledger.addMoney(pk, 1000000)
-	}
-	go p.startSendingBlocks()
+// Starts the chain from the genesis. Only the first genesis counts, so a
+// genesis from the network can not hand out money again on a chain started
+// from a genesis file. The slot loop waits for Start to catch up with the
+// chain before it draws.
+func (p *Peer) initializeGenesis(g genesis) {
+	p.genesisOnce.Do(func() {
+		p.treeMu.Lock()
+		p.genesis = &g
+		p.treeMu.Unlock()
+
+		p.blockInfo.seed = g.Seed
+		p.rpc.SetGenesis(hashObject(g))
+		for _, pk := range g.Pks {
+			p.ledger.addMoney(pk, genesisBalance)
+		}
+		// A replayed peer gets its blocks from the recording
+		if !p.replaying {
+			p.spawn(p.startSendingBlocks)
+		}
+	})
 }
@@ -0,0 +1,58 @@
+package dsys
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+const keyBits = 2048
+
+// Reads the private key in the PEM file. If the file does not exist, a new key
+// is generated and written to it.
+func LoadKey(file string) (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return generateKey(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, fmt.Errorf("%w: %s holds no RSA private key", ErrBadKey, file)
+	}
+	sk, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrBadKey, file, err)
+	}
+	return sk, nil
+}
+
+func generateKey(file string) (*rsa.PrivateKey, error) {
+	sk, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, err
+	}
+
+	b := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(sk),
+	})
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+// Returns the public key encoded the way accounts are named in genesis files
+// and transactions.
+func EncodeKey(pk rsa.PublicKey) string {
+	return encodePk(pk)
+}
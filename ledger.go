@@ -1,9 +1,8 @@
-package main
+package dsys
 
 import (
 	"crypto/rsa"
 	"fmt"
-	"log"
 	"sort"
 	"sync"
 
@@ -33,6 +32,26 @@ func MakeLedger(id string, sk *rsa.PrivateKey) *Ledger {
 	return l
 }
 
+// Returns a copy of the balances and of the transactions done, to work out
+// the ledger of another chain.
+func (l *Ledger) copy() *Ledger {
+	c := new(Ledger)
+	c.aliases = bimap.NewBiMap()
+	l.accountsMu.RLock()
+	c.Accounts = make(map[string]int, len(l.Accounts))
+	for pk, balance := range l.Accounts {
+		c.Accounts[pk] = balance
+	}
+	l.accountsMu.RUnlock()
+	l.transactionsDoneMu.Lock()
+	c.transactionsDone = make(map[string]bool, len(l.transactionsDone))
+	for id, done := range l.transactionsDone {
+		c.transactionsDone[id] = done
+	}
+	l.transactionsDoneMu.Unlock()
+	return c
+}
+
 type transaction struct {
 	ID     string
 	From   string
@@ -40,10 +59,11 @@ type transaction struct {
 	Amount int
 }
 
+// Creates a transaction to the account, given by its alias or key.
 func (l *Ledger) createTransaction(to string, amount int) (*transaction, error) {
-	pk := l.aliasToPk(to)
+	pk := l.account(to)
 	if pk == "" {
-		return nil, fmt.Errorf("invalid transaction receiver %v", to)
+		return nil, fmt.Errorf("%w: %v", ErrUnknownAccount, to)
 	}
 
 	return &transaction{
@@ -59,62 +79,64 @@ type signedTransaction struct {
 	Signature   []byte
 }
 
-func (p *peer) createSignedTransaction(to string, amount int) *signedTransaction {
+func (p *Peer) createSignedTransaction(to string, amount int) (*signedTransaction, error) {
 	t, err := p.ledger.createTransaction(to, amount)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	signature, err := p.sign(t)
+	if err != nil {
+		return nil, err
 	}
 
 	return &signedTransaction{
 		Transaction: *t,
-		Signature:   p.sign(t),
-	}
+		Signature:   signature,
+	}, nil
 }
 
-func (l *Ledger) transaction(t transaction) {
-	l.addTransactionDone(t)
-
+func (l *Ledger) transaction(t transaction) error {
 	if t.Amount < 1 {
-		fmt.Println("invalid transaction amount")
-		return
+		return ErrInvalidAmount
 	}
 
-	//check if sending account becomes negative, but without mutating
-	l.accountsMu.RLock()
+	//check if sending account becomes negative before mutating
+	l.accountsMu.Lock()
+	defer l.accountsMu.Unlock()
 	if l.Accounts[t.From] < t.Amount {
-		fmt.Println("sender will be negative, rejecting transaction")
-		// debug.PrintStack()
-		return
+		return ErrInsufficientFunds
 	}
-	l.accountsMu.RUnlock()
 
+	// More than one block of a chain may hold the transaction
+	if !l.addTransactionDone(t) {
+		return ErrKnownTransaction
+	}
 	l.transfer(t.From, t.To, t.Amount-1)
+	return nil
 }
 
-func (l *Ledger) reverseTransaction(t transaction) {
+func (l *Ledger) reverseTransaction(t transaction) error {
 	t.From, t.To = t.To, t.From
 
-	l.removeTransactionDone(t)
-
 	if t.Amount < 1 {
-		fmt.Println("invalid transaction amount")
-		return
+		return ErrInvalidAmount
 	}
 
-	//check if sending account becomes negative, but without mutating
-	l.accountsMu.RLock()
-	if l.Accounts[t.From] < t.Amount {
-		fmt.Println("sender will be negative, rejecting transaction...")
-		return
+	// Moves back what the transaction moved, the fee aside
+	l.accountsMu.Lock()
+	defer l.accountsMu.Unlock()
+	if l.Accounts[t.From] < t.Amount-1 {
+		return ErrInsufficientFunds
 	}
-	l.accountsMu.RUnlock()
 
-	l.transfer(t.From, t.To, t.Amount+1)
+	l.removeTransactionDone(t)
+	l.transfer(t.From, t.To, t.Amount-1)
+	return nil
 }
 
+// Moves the amount between the accounts. accountsMu must be held.
 func (l *Ledger) transfer(from string, to string, amount int) {
-	l.accountsMu.Lock()
-	defer l.accountsMu.Unlock()
 	l.Accounts[from] -= amount
 	l.Accounts[to] += amount
 }
@@ -139,11 +161,19 @@ func (l *Ledger) removeTransactionDone(t transaction) bool {
 	return true
 }
 
-func (l *Ledger) addAccount(id string, pk rsa.PublicKey) {
+// Binds the alias to the key of the account. An alias is never bound to
+// another key, or a peer could take the money sent to another by alias.
+func (l *Ledger) addAccount(id string, pk rsa.PublicKey) error {
 	l.accountsMu.Lock()
 	defer l.accountsMu.Unlock()
-	l.Accounts[encodePk(pk)] = 0
+	if bound := l.aliasToPk(id); bound != "" && bound != encodePk(pk) {
+		return fmt.Errorf("%w: %v", ErrAliasTaken, id)
+	}
+	if _, ok := l.Accounts[encodePk(pk)]; !ok {
+		l.Accounts[encodePk(pk)] = 0
+	}
 	l.aliases.Insert(id, encodePk(pk))
+	return nil
 }
 
 func (l *Ledger) addMoney(pk rsa.PublicKey, amount int) {
@@ -166,6 +196,18 @@ func (l *Ledger) aliasToPk(alias string) string {
 	return pk.(string)
 }
 
+// Returns the key of the account given by its alias or key, or "" if it is
+// neither.
+func (l *Ledger) account(name string) string {
+	if pk := l.aliasToPk(name); pk != "" {
+		return pk
+	}
+	if _, err := decodePk(name); err == nil {
+		return name
+	}
+	return ""
+}
+
 func (l *Ledger) pkToAlias(pk string) string {
 	alias, ok := l.aliases.GetInverse(pk)
 	if !ok {
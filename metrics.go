@@ -0,0 +1,61 @@
+package dsys
+
+import (
+	"dsys/metrics"
+	"fmt"
+)
+
+// Metrics of the chain, exported together with the metrics of the rpc.
+type consensusMetrics struct {
+	slot        *metrics.Gauge
+	chainLength *metrics.Gauge
+	forks       *metrics.Gauge
+	reorgs      *metrics.Gauge
+	reorgDepth  *metrics.Gauge
+	blocksWon   *metrics.Counter
+}
+
+func (p *Peer) initializeMetrics() {
+	registry := p.rpc.Metrics().Registry()
+	p.metrics = consensusMetrics{
+		slot:        registry.Gauge("dsys_slot", "The current slot.").With(),
+		chainLength: registry.Gauge("dsys_chain_length", "Blocks in the longest chain.").With(),
+		forks:       registry.Gauge("dsys_forks", "Blocks added next to another child of their parent.").With(),
+		reorgs:      registry.Gauge("dsys_reorgs", "Times we switched to another branch.").With(),
+		reorgDepth:  registry.Gauge("dsys_reorg_depth", "Blocks undone by the last switch to another branch.").With(),
+		blocksWon:   registry.Counter("dsys_blocks_won_total", "Blocks we won the lottery for and sent.").With(),
+	}
+
+	registry.GaugeFunc("dsys_mempool_size", "Transactions waiting to be put in a block.", func() float64 {
+		p.transactionsQueueMu.Lock()
+		defer p.transactionsQueueMu.Unlock()
+		return float64(len(p.transactionsQueue))
+	})
+	registry.GaugeFunc("dsys_orphans", "Blocks waiting for their parent.", func() float64 {
+		return float64(p.orphans.len())
+	})
+	registry.GaugeFunc("dsys_pending_blocks", "Blocks waiting for their transactions.", func() float64 {
+		return float64(p.pending.len())
+	})
+}
+
+// Updates the metrics of the tree after a block was added. treeMu must be
+// held.
+func (p *Peer) observeTree() {
+	p.metrics.chainLength.Set(float64(p.tree.current.Length))
+	p.metrics.forks.Set(float64(p.tree.forks))
+	p.metrics.reorgs.Set(float64(p.tree.reorgs))
+	p.metrics.reorgDepth.Set(float64(p.tree.reorgDepth))
+}
+
+// Serves the metrics of the peer in the Prometheus text format on
+// http://address/metrics until the peer is closed.
+func (p *Peer) ServeMetrics(address string) error {
+	ln, err := metrics.Serve(address, p.rpc.Metrics().Registry())
+	if err != nil {
+		return err
+	}
+	p.metricsListener = ln
+	fmt.Printf("%s is serving metrics on: %s\n", p.info.Alias, ln.Addr())
+	return nil
+}
@@ -0,0 +1,239 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+	A small set of Prometheus-style metrics. Metrics are registered in a
+	Registry under a name, and may have labels, in which case each set of
+	label values is its own series. The registry writes all of them in the
+	Prometheus text format.
+*/
+
+// The histogram buckets used if none are given, in seconds.
+var DefaultBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
+type kind string
+
+const (
+	counterKind   kind = "counter"
+	gaugeKind     kind = "gauge"
+	histogramKind kind = "histogram"
+)
+
+// Holds registered metrics.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// A metric and all its series.
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+	value   func() float64 // Set for gauges that are computed when read
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// The value of a metric for one set of label values.
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64 // Per bucket, for histograms
+	count  uint64
+}
+
+type Counter struct {
+	f *family
+	s *series
+}
+
+type Gauge struct {
+	f *family
+	s *series
+}
+
+type Histogram struct {
+	f *family
+	s *series
+}
+
+type CounterVec struct{ f *family }
+type GaugeVec struct{ f *family }
+type HistogramVec struct{ f *family }
+
+// Registers a counter with the given label names. Registering a name twice
+// returns the metric registered first.
+func (r *Registry) Counter(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, counterKind, labels, nil)}
+}
+
+// Registers a gauge with the given label names.
+func (r *Registry) Gauge(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, gaugeKind, labels, nil)}
+}
+
+// Registers a gauge whose value is computed by f whenever it is read.
+func (r *Registry) GaugeFunc(name string, help string, f func() float64) {
+	r.register(name, help, gaugeKind, nil, nil).value = f
+}
+
+// Registers a histogram with the given upper bounds of its buckets, or the
+// default buckets if nil, and label names.
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{r.register(name, help, histogramKind, labels, buckets)}
+}
+
+func (r *Registry) register(name string, help string, k kind, labels []string, buckets []float64) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.kind != k {
+			panic(fmt.Sprintf("metrics: %s is already registered as a %s", name, f.kind))
+		}
+		return f
+	}
+
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    k,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+// Returns the series with the given label values, creating it if needed.
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: append([]string{}, values...)}
+		if f.kind == histogramKind {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (v *CounterVec) With(values ...string) *Counter {
+	return &Counter{v.f, v.f.with(values)}
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{v.f, v.f.with(values)}
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{v.f, v.f.with(values)}
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Adds to the counter. Counters only go up, so negative values are ignored.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.s.value += v
+}
+
+func (c *Counter) Value() float64 {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	return c.s.value
+}
+
+func (g *Gauge) Set(v float64) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.s.value = v
+}
+
+func (g *Gauge) Add(v float64) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.s.value += v
+}
+
+func (g *Gauge) Value() float64 {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	return g.s.value
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	for i, bound := range h.f.buckets {
+		if v <= bound {
+			h.s.counts[i]++
+		}
+	}
+	h.s.count++
+	h.s.value += v
+}
+
+// Returns the number of observations and their sum.
+func (h *Histogram) Value() (uint64, float64) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	return h.s.count, h.s.value
+}
+
+// Returns the families sorted by name.
+func (r *Registry) sorted() []*family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	return families
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	// Families are written sorted by name, series by label values, with
+	// escaped labels and cumulative histogram buckets
+	r := NewRegistry()
+	messages := r.Counter("messages_total", "Messages.\nAll of them.", "function")
+	messages.With("b").Inc()
+	messages.With("a\"").Add(2)
+	messages.With("a\"").Add(-1)
+	r.Gauge("connections", "Connections.").With().Set(3)
+	r.GaugeFunc("computed", "Computed when read.", func() float64 { return 1.5 })
+	latency := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}).With()
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP computed Computed when read.
+# TYPE computed gauge
+computed 1.5
+# HELP connections Connections.
+# TYPE connections gauge
+connections 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+# HELP messages_total Messages.\nAll of them.
+# TYPE messages_total counter
+messages_total{function="a\""} 2
+messages_total{function="b"} 1
+`
+	if buf.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, buf.String())
+	}
+}
+
+func TestLabelValues(t *testing.T) {
+	// A series must be given a value for every label
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a missing label value to panic")
+		}
+	}()
+	NewRegistry().Counter("messages_total", "Messages.", "function", "direction").With("a")
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The content type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Writes every metric in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range r.sorted() {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Serves the metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteText(w)
+}
+
+// Serves the metrics of the registry on /metrics at the address until the
+// listener is closed. Returns the listener so the caller can close it.
+func Serve(address string, r *Registry) (net.Listener, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	go http.Serve(ln, mux)
+	return ln, nil
+}
+
+func (f *family) write(w *bufio.Writer) {
+	w.WriteString("# HELP " + f.name + " " + escapeHelp(f.help) + "\n")
+	w.WriteString("# TYPE " + f.name + " " + string(f.kind) + "\n")
+
+	if f.value != nil {
+		w.WriteString(f.name + " " + formatFloat(f.value()) + "\n")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != histogramKind {
+			w.WriteString(f.name + labels(f.labels, s.labels, "", "") + " " + formatFloat(s.value) + "\n")
+			continue
+		}
+
+		for i, bound := range f.buckets {
+			w.WriteString(f.name + "_bucket" + labels(f.labels, s.labels, "le", formatFloat(bound)) + " " + formatFloat(float64(s.counts[i])) + "\n")
+		}
+		w.WriteString(f.name + "_bucket" + labels(f.labels, s.labels, "le", "+Inf") + " " + formatFloat(float64(s.count)) + "\n")
+		w.WriteString(f.name + "_sum" + labels(f.labels, s.labels, "", "") + " " + formatFloat(s.value) + "\n")
+		w.WriteString(f.name + "_count" + labels(f.labels, s.labels, "", "") + " " + formatFloat(float64(s.count)) + "\n")
+	}
+}
+
+// Returns the label set of a series, with an extra label if its name is not
+// empty.
+func labels(names []string, values []string, extraName string, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+"=\""+escapeLabel(values[i])+"\"")
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"=\""+extraValue+"\"")
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
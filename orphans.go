@@ -0,0 +1,228 @@
+package dsys
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	A block whose parent we do not have waits in the orphan pool, while we
+	ask the peer that sent it for the parent, or our other neighbours if it
+	does not have it, and for the parent's parent if that is missing too. A
+	parent that could not be got is asked for again when the next orphan
+	waiting for it arrives. Once a block is added to the tree, the orphans that
+	waited for it are added after it. The pool is bounded, and orphans whose
+	ancestors never come expire.
+*/
+
+const (
+	// How many orphans we keep. The oldest goes when another comes.
+	maxOrphans = 256
+	// How long an orphan waits for its parent
+	orphanExpiry = time.Minute
+)
+
+type orphan struct {
+	block block
+	added time.Time
+}
+
+// Blocks whose parent we do not have, by the parent they wait for.
+type orphanPool struct {
+	mu       sync.Mutex
+	byParent map[string][]orphan
+	fetching map[string]bool // The parents being asked for
+	count    int
+}
+
+func makeOrphanPool() *orphanPool {
+	return &orphanPool{
+		byParent: make(map[string][]orphan),
+		fetching: make(map[string]bool),
+	}
+}
+
+func parentKey(slot int, hash []byte) string {
+	return fmt.Sprintf("%d/%x", slot, hash)
+}
+
+// Adds the block to the pool, unless it is there already. Returns true if
+// nobody is asking for its parent, which then has to be asked for and marked
+// fetched once the asking is over.
+func (o *orphanPool) add(b block, now time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.expire(now)
+
+	key := parentKey(b.Ps, b.Ph)
+	known := false
+	for _, x := range o.byParent[key] {
+		known = known || bytes.Equal(x.block.Shb, b.Shb)
+	}
+	if !known {
+		if o.count >= maxOrphans {
+			o.removeOldest()
+		}
+		o.byParent[key] = append(o.byParent[key], orphan{block: b, added: now})
+		o.count++
+	}
+
+	if o.fetching[key] {
+		return false
+	}
+	o.fetching[key] = true
+	return true
+}
+
+// Marks the asking for the parent with the given slot and hash as over,
+// whether it arrived or not.
+func (o *orphanPool) fetched(slot int, hash []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.fetching, parentKey(slot, hash))
+}
+
+// Removes and returns the orphans waiting for the block with the given slot
+// and hash.
+func (o *orphanPool) take(slot int, hash []byte, now time.Time) []block {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.expire(now)
+
+	key := parentKey(slot, hash)
+	blocks := []block{}
+	for _, x := range o.byParent[key] {
+		blocks = append(blocks, x.block)
+	}
+	o.count -= len(o.byParent[key])
+	delete(o.byParent, key)
+	return blocks
+}
+
+func (o *orphanPool) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.count
+}
+
+// mu must be held.
+func (o *orphanPool) expire(now time.Time) {
+	for key, orphans := range o.byParent {
+		kept := orphans[:0]
+		for _, x := range orphans {
+			if now.Sub(x.added) < orphanExpiry {
+				kept = append(kept, x)
+			}
+		}
+		o.count -= len(orphans) - len(kept)
+		if len(kept) == 0 {
+			delete(o.byParent, key)
+		} else {
+			o.byParent[key] = kept
+		}
+	}
+}
+
+// mu must be held.
+func (o *orphanPool) removeOldest() {
+	oldestKey, oldest := "", -1
+	for key, orphans := range o.byParent {
+		for i, x := range orphans {
+			if oldest == -1 || x.added.Before(o.byParent[oldestKey][oldest].added) {
+				oldestKey, oldest = key, i
+			}
+		}
+	}
+	if oldest == -1 {
+		return
+	}
+
+	orphans := o.byParent[oldestKey]
+	orphans = append(orphans[:oldest], orphans[oldest+1:]...)
+	o.count--
+	if len(orphans) == 0 {
+		delete(o.byParent, oldestKey)
+	} else {
+		o.byParent[oldestKey] = orphans
+	}
+}
+
+// Where a block is in the tree.
+type blockRef struct {
+	Slot int
+	Hash []byte
+}
+
+func (p *Peer) sendGetBlock(conn net.Conn, ref blockRef) (syncedBlock, error) {
+	var sb syncedBlock
+	err := p.rpc.Call(conn, "getBlock", ref, &sb, callTimeout)
+	return sb, err
+}
+
+func (p *Peer) receivedGetBlock(conn net.Conn, ref blockRef) (syncedBlock, error) {
+	p.treeMu.RLock()
+	defer p.treeMu.RUnlock()
+	p.transactionsMu.RLock()
+	defer p.transactionsMu.RUnlock()
+
+	if ref.Slot >= 0 && ref.Slot < len(p.tree.nodes) {
+		for _, n := range p.tree.nodes[ref.Slot] {
+			b, ok := p.blocks[n]
+			if ok && bytes.Equal(n.hash(), ref.Hash) {
+				return p.syncedBlockOf(b), nil
+			}
+		}
+	}
+	return syncedBlock{}, fmt.Errorf("%w: slot %d", ErrUnknownBlock, ref.Slot)
+}
+
+// Keeps a block whose parent we do not have, and asks for the parent unless
+// it is being asked for already.
+func (p *Peer) addOrphan(conn net.Conn, b block) {
+	if !p.orphans.add(b, time.Now()) {
+		return
+	}
+	fmt.Printf("%s holds block of slot %d until its parent of slot %d arrives\n", p.info.Alias, b.Slot, b.Ps)
+
+	// A replayed peer has nobody to ask, and gets the parent from the
+	// recording if the recorded peer got it flooded
+	if p.replaying {
+		return
+	}
+	ref := blockRef{Slot: b.Ps, Hash: b.Ph}
+	if !p.spawn(func() { p.fetchBlock(conn, ref) }) {
+		p.orphans.fetched(ref.Slot, ref.Hash)
+	}
+}
+
+// Gets a block we are missing from the peer, or from our other neighbours if
+// it can not give it to us. It is checked like a flooded block, so if its
+// parent is missing too, that is asked for next.
+func (p *Peer) fetchBlock(conn net.Conn, ref blockRef) {
+	defer p.orphans.fetched(ref.Slot, ref.Hash)
+
+	conns := []net.Conn{conn}
+	for _, c := range p.rpc.Connections() {
+		if c != conn {
+			conns = append(conns, c)
+		}
+	}
+
+	for _, c := range conns {
+		sb, err := p.sendGetBlock(c, ref)
+		if err != nil {
+			fmt.Printf("%s could not get block of slot %d: %v\n", p.info.Alias, ref.Slot, err)
+			continue
+		}
+		for _, st := range sb.Transactions {
+			if err := p.receivedSignedTransaction(c, st); err != nil {
+				return
+			}
+		}
+		p.receivedBlock(c, sb.Block)
+		return
+	}
+}
@@ -1,106 +1,324 @@
-package main
+package dsys
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"dsys/rpc"
+	"errors"
+	"fmt"
 	random "math/rand"
 	"net"
+	"os"
 	"sync"
+	"time"
 )
 
-type peer struct {
+type Peer struct {
 	info peerInfo
 
-	listener net.Listener
-	rpc      *rpc.Rpc
+	listener  net.Listener
+	rpc       *rpc.Rpc
+	transport rpc.Transport
 
 	peerInfoList   []peerInfo
 	peerInfoListMu sync.Mutex
 
 	sk                  *rsa.PrivateKey
 	blockInfo           blockInfo
+	blockInfoMu         sync.RWMutex // Held while the slot is moved on, or read outside the slot loop
 	tree                tree
-	transactions        map[string]transaction
+	treeMu              sync.RWMutex    // Held while the tree or the chain is read or changed
+	blocks              map[*node]block // The block of every node but the genesis, guarded by treeMu
+	genesis             *genesis        // Set once the chain has started, guarded by treeMu
+	transactions        map[string]signedTransaction
 	transactionsMu      sync.RWMutex
+	failed              map[blockTransaction]error // Transactions of the chain the ledger rejected
+	failedMu            sync.Mutex
 	transactionsQueue   []string
 	transactionsQueueMu sync.Mutex
 
 	ledger       *Ledger
-	initializing chan struct{}
+	initializing chan struct{} // Closed once Start has synced the chain
+
+	metrics         consensusMetrics
+	metricsListener net.Listener // Set if metrics are served
+	apiListener     net.Listener // Set if the API is served
+
+	initialGenesis *genesis // Set if the chain starts from a genesis file
+	genesisOnce    sync.Once
+
+	recording *os.File // Set if the frames of the peer are recorded
+	replaying bool     // Set if the peer is driven by a recording
+
+	events  *eventHub
+	orphans *orphanPool
+	pending *pendingPool // Blocks waiting for their transactions
+
+	neighbours   int           // How many connections we try to keep
+	disconnected chan struct{} // Signaled when a connection breaks
+
+	closed    chan struct{} // Closed when the peer is shut down
+	closeOnce sync.Once
+	lifeMu    sync.Mutex     // Guards closing and adding to wg
+	wg        sync.WaitGroup // Goroutines started with spawn
 }
 
-func createPeer(id string) *peer {
-	sk, _ := rsa.GenerateKey(rand.Reader, 2048)
+const (
+	// How often we check that we have enough neighbours
+	neighbourInterval = time.Second
+	// How often we compare recently flooded messages with a neighbour
+	antiEntropyInterval = time.Second
+	// How long a slot lasts
+	slotDuration = time.Second
+	// How long to wait before accepting again after a failed accept
+	acceptRetryDelay = 100 * time.Millisecond
+	// How long Start gives Shutdown when its context is done
+	shutdownTimeout = 10 * time.Second
+)
 
-	return &peer{
+// Returns a peer with the given alias and key. It joins a network when it is
+// started.
+func NewPeer(alias string, sk *rsa.PrivateKey) *Peer {
+	return &Peer{
 		info: peerInfo{
-			Alias: id,
+			Alias: alias,
 			Pk:    sk.PublicKey,
 		},
 
+		transport: rpc.TCP,
+
 		sk:                sk,
-		transactions:      make(map[string]transaction),
+		blocks:            make(map[*node]block),
+		transactions:      make(map[string]signedTransaction),
+		failed:            make(map[blockTransaction]error),
 		transactionsQueue: []string{},
 
-		ledger:       MakeLedger(id, sk),
+		ledger:       MakeLedger(alias, sk),
 		initializing: make(chan struct{}),
+
+		neighbours:   10,
+		disconnected: make(chan struct{}, 1),
+		closed:       make(chan struct{}),
+		events:       makeEventHub(),
+		orphans:      makeOrphanPool(),
+		pending:      &pendingPool{},
 	}
 }
 
+func createPeer(id string) *Peer {
+	sk, _ := rsa.GenerateKey(rand.Reader, keyBits)
+	return NewPeer(id, sk)
+}
+
 type peerInfo struct {
-	Alias   string
-	Address string
-	Pk      rsa.PublicKey
+	Alias     string
+	Address   string
+	Pk        rsa.PublicKey
+	Signature []byte // Of the alias, address and key, by the peer itself
 }
 
-func (p *peer) ConnectAndListen(connectAddress string, listenAddress string) {
-	p.initialize(listenAddress)
+// Returns whether the peer signed its alias, address and key, so nobody else
+// can announce it.
+func (info peerInfo) verify() bool {
+	return verifySignature(&info.Pk, info.Signature, info.Alias, info.Address, info.Pk)
+}
 
-	if connectAddress != "" {
-		conn := tryConnect(connectAddress)
-		p.rpc.AddConnection(conn)
-		p.sendGetPeerInfoList(conn) // Starts listening when received
-	} else {
-		go p.listenForConnections()
+// Listens on the listen address and joins the network through the first of
+// the bootstrap peers that answers, from which it syncs the chain before it
+// returns. Without bootstrap peers it starts a network of its own. The peer
+// runs until the context is done or Shutdown is called.
+func (p *Peer) Start(ctx context.Context, listenAddress string, bootstrap ...string) error {
+	if err := p.initialize(listenAddress); err != nil {
+		return err
 	}
 
-	<-p.initializing
+	// The rpc is shut down with the peer, after the slot loop has stopped
+	p.rpc.Start(context.Background())
+
+	// Before connecting, so our hello carries the genesis
+	if p.initialGenesis != nil {
+		p.initializeGenesis(*p.initialGenesis)
+	}
+
+	var conn net.Conn
+	if len(bootstrap) > 0 {
+		peerInfoList, c, err := p.bootstrap(bootstrap)
+		if err != nil {
+			p.Shutdown(ctx)
+			return err
+		}
+		conn = c
+		p.connectToPeers(peerInfoList)
+	}
+
+	p.spawn(p.listenForConnections)
+	p.spawn(p.keepNeighbours)
+
+	// The slot loop waits for this, so we draw on the chain the others have
+	if conn != nil {
+		if err := p.sync(ctx, conn); err != nil {
+			fmt.Printf("%s could not sync the chain: %v\n", p.info.Alias, err)
+		}
+	}
+	close(p.initializing)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			p.Shutdown(ctx)
+		case <-p.closed:
+		}
+	}()
+	return nil
 }
 
-func (p *peer) connectToPeers(peerInfoList []peerInfo) {
-	p.peerInfoList = append(peerInfoList, p.info)
+// Asks the bootstrap peers for the peers they know, one after the other until
+// one answers. Returns the connection to the one that answered.
+func (p *Peer) bootstrap(addresses []string) ([]peerInfo, net.Conn, error) {
+	var err error
+	for _, address := range addresses {
+		var conn net.Conn
+		conn, err = p.rpc.Dial(address)
+		if err != nil {
+			fmt.Printf("%s could not reach %s: %v\n", p.info.Alias, address, err)
+			continue
+		}
 
-	startIndex := max(len(peerInfoList)-10, 0)
-	// All but the sender since they are already added
-	for _, info := range peerInfoList[startIndex : len(peerInfoList)-1] {
-		p.rpc.AddConnection(tryConnect(info.Address))
+		var peerInfoList []peerInfo
+		peerInfoList, err = p.sendGetPeerInfoList(conn)
+		if err == nil {
+			return peerInfoList, conn, nil
+		}
+		fmt.Printf("%s got no peers from %s: %v\n", p.info.Alias, address, err)
+		p.rpc.RemoveConnection(conn)
 	}
+	return nil, nil, err
+}
 
+func (p *Peer) connectToPeers(peerInfoList []peerInfo) {
+	// The list is only as good as the peer that sent it
 	for _, info := range peerInfoList {
-		p.ledger.addAccount(info.Alias, info.Pk)
+		if _, err := p.addPeer(info); err != nil {
+			fmt.Printf("%s left out %s: %v\n", p.info.Alias, info.Alias, err)
+		}
 	}
 
+	p.findNeighbours()
 	p.broadcastPresence(p.info)
 }
 
-func (p *peer) listenForConnections() {
+// Looks for new neighbours whenever a connection breaks, and every once in a
+// while in case a redial gave up.
+func (p *Peer) keepNeighbours() {
+	ticker := time.NewTicker(neighbourInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-p.disconnected:
+		case <-ticker.C:
+		}
+		p.findNeighbours()
+	}
+}
+
+// Dials random peers we are not connected to until we have enough neighbours.
+// Connections that are being redialed count as neighbours.
+func (p *Peer) findNeighbours() {
+	missing := p.neighbours - p.rpc.ConnectionCount() - p.rpc.Redialing()
+	if missing <= 0 {
+		return
+	}
+
+	connected := make(map[string]bool)
+	for _, conn := range p.rpc.Connections() {
+		if pk, ok := p.rpc.PeerKey(conn); ok {
+			connected[encodePk(*pk)] = true
+		}
+	}
+
+	p.peerInfoListMu.Lock()
+	candidates := append([]peerInfo{}, p.peerInfoList...)
+	p.peerInfoListMu.Unlock()
+	random.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	for _, info := range candidates {
+		if missing == 0 {
+			return
+		}
+		if info.Address == p.info.Address || connected[encodePk(info.Pk)] {
+			continue
+		}
+		if err := p.dialPeer(info); err != nil {
+			fmt.Printf("%s could not connect to %s: %v\n", p.info.Alias, info.Alias, err)
+			continue
+		}
+		missing--
+	}
+}
+
+// Connects to the peer and makes sure we are talking to the peer the info
+// says is on the address.
+func (p *Peer) dialPeer(info peerInfo) error {
+	conn, err := p.rpc.Dial(info.Address)
+	if err != nil {
+		return err
+	}
+
+	if pk, ok := p.rpc.PeerKey(conn); !ok || encodePk(*pk) != encodePk(info.Pk) {
+		p.rpc.RemoveConnection(conn)
+		return fmt.Errorf("unexpected key at %s", info.Address)
+	}
+	return nil
+}
+
+// Called by the rpc handler when a connection is removed.
+func (p *Peer) disconnectedFrom(conn net.Conn, err error) {
+	if err == nil {
+		return
+	}
+	select {
+	case p.disconnected <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Peer) listenForConnections() {
 	println(p.info.Alias + " is listening on address: " + p.info.Address)
 	defer p.listener.Close()
 
-	close(p.initializing)
-
 	for {
 		conn, err := p.listener.Accept() // A peer tries to connect to this peer
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
+			fmt.Printf("%s could not accept connection: %v\n", p.info.Alias, err)
+			select {
+			case <-p.closed:
+				return
+			case <-time.After(acceptRetryDelay):
+			}
 			continue
 		}
 
-		p.rpc.AddConnection(conn)
+		// The handshake takes a round trip, so it does not hold up accepting
+		p.spawn(func() {
+			if err := p.rpc.AddConnection(conn); err != nil {
+				fmt.Printf("%s could not add connection: %v\n", p.info.Alias, err)
+			}
+		})
 	}
 }
 
-func (p *peer) SendGenesis(peerList ...*peer) {
+func (p *Peer) SendGenesis(peerList ...*Peer) {
 	pks := make([]rsa.PublicKey, len(peerList))
 	for i, pk := range peerList {
 		pks[i] = pk.sk.PublicKey
@@ -115,30 +333,167 @@ func (p *peer) SendGenesis(peerList ...*peer) {
 	p.initializeGenesis(g)
 }
 
-func (p *peer) SendTransaction(to string, amount int) {
-	st := p.createSignedTransaction(to, amount)
-	p.addTransaction(st.Transaction)
-	p.addToQueue(st.Transaction.ID)
+// Sends the amount to the account, given by its alias or key. Returns the id
+// of the transaction.
+func (p *Peer) SendTransaction(to string, amount int) (string, error) {
+	st, err := p.createSignedTransaction(to, amount)
+	if err != nil {
+		return "", err
+	}
+	// Queued once sent, so none of our blocks holds it before a recording does
+	p.addTransaction(*st, false)
 	p.broadcastSignedTransaction(*st)
+	p.addToQueue(st.Transaction.ID)
+	return st.Transaction.ID, nil
 }
 
-func (p *peer) addToPeerInfoList(info peerInfo) {
+// Adds the peer to the list, unless it is already there. Returns true if it
+// was added.
+func (p *Peer) addToPeerInfoList(info peerInfo) bool {
 	p.peerInfoListMu.Lock()
 	defer p.peerInfoListMu.Unlock()
+	for _, x := range p.peerInfoList {
+		if encodePk(x.Pk) == encodePk(info.Pk) {
+			return false
+		}
+	}
 	p.peerInfoList = append(p.peerInfoList, info)
+	return true
 }
 
-func (p *peer) addTransaction(t transaction) {
+// Adds the peer to the list and its alias to the ledger, if it signed its
+// presence and its alias is not bound to another key. Returns true if it was
+// not in the list.
+func (p *Peer) addPeer(info peerInfo) (bool, error) {
+	if !info.verify() {
+		return false, ErrBadSignature
+	}
+	if err := p.ledger.addAccount(info.Alias, info.Pk); err != nil {
+		return false, err
+	}
+	return p.addToPeerInfoList(info), nil
+}
+
+// Keeps the transaction with its signature, so peers that sync the chain
+// from us can check it. A new transaction is queued for our blocks if queue
+// is set, before the blocks that waited for it are added, as they take it
+// out of the queue again.
+func (p *Peer) addTransaction(st signedTransaction, queue bool) {
+	t := st.Transaction
 	p.transactionsMu.Lock()
-	defer p.transactionsMu.Unlock()
-	p.transactions[t.ID] = t
+	_, known := p.transactions[t.ID]
+	p.transactions[t.ID] = st
+	p.transactionsMu.Unlock()
+
+	if !known {
+		p.transactionEvent(TransactionReceived, t)
+		if queue {
+			p.addToQueue(t.ID)
+		}
+		p.transactionArrived(t.ID)
+	}
+}
+
+// Stops the peer: the slot loop and neighbour upkeep stop, the listeners are
+// closed, and the rpc is shut down gracefully. Returns when everything has
+// stopped, or with the error of the context if it is done first.
+func (p *Peer) Shutdown(ctx context.Context) error {
+	p.lifeMu.Lock()
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	p.lifeMu.Unlock()
+
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	if p.metricsListener != nil {
+		p.metricsListener.Close()
+	}
+	if p.apiListener != nil {
+		p.apiListener.Close()
+	}
+
+	// Our goroutines may be waiting on the rpc, so it is shut down first
+	rpcErr := p.rpc.Shutdown(ctx)
+	p.events.close()
+	if p.recording != nil {
+		p.rpc.SetRecorder(nil)
+		p.recording.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return rpcErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shuts the peer down without a deadline.
+func (p *Peer) Close() {
+	p.Shutdown(context.Background())
+}
+
+// Runs f on its own goroutine, which Shutdown waits for. Returns false
+// without running f if the peer is shut down.
+func (p *Peer) spawn(f func()) bool {
+	p.lifeMu.Lock()
+	defer p.lifeMu.Unlock()
+	select {
+	case <-p.closed:
+		return false
+	default:
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// A summary of the state of a peer.
+type Status struct {
+	Alias       string
+	Address     string
+	Slot        int
+	ChainLength int
+	Connections int
+	Mempool     int // Transactions waiting to be put in a block
 }
 
-func (p *peer) Close() {
-	p.rpc.RemoveAllConnections()
-	p.listener.Close()
+func (p *Peer) Status() Status {
+	p.transactionsQueueMu.Lock()
+	mempool := len(p.transactionsQueue)
+	p.transactionsQueueMu.Unlock()
+
+	p.treeMu.RLock()
+	length := p.tree.current.Length
+	p.treeMu.RUnlock()
+
+	return Status{
+		Alias:       p.info.Alias,
+		Address:     p.info.Address,
+		Slot:        p.currentSlot(),
+		ChainLength: length,
+		Connections: p.rpc.ConnectionCount(),
+		Mempool:     mempool,
+	}
 }
 
-func (p *peer) PrintTree() {
+func (p *Peer) PrintTree() {
+	p.treeMu.RLock()
+	defer p.treeMu.RUnlock()
 	p.tree.print(p.info.Alias)
 }
+
+func (p *Peer) PrintAccounts() {
+	p.ledger.printAccounts()
+}
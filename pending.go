@@ -0,0 +1,193 @@
+package dsys
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	Blocks only carry the ids of their transactions, which usually reach us
+	before the block does. A block holding transactions we do not have is
+	kept pending while we ask the peer that sent it for them, and then our
+	other neighbours. It is added to the tree once we have every one of its
+	transactions, checked like flooded ones. Like orphans, pending blocks are
+	bounded and expire.
+*/
+
+const (
+	// How many blocks may wait for transactions. The oldest goes when
+	// another comes.
+	maxPendingBlocks = 256
+	// How long a block waits for its transactions
+	pendingExpiry = time.Minute
+)
+
+type pendingBlock struct {
+	block   block
+	conn    net.Conn // The peer that sent the block
+	missing map[string]bool
+	added   time.Time
+}
+
+// Blocks waiting for transactions we do not have.
+type pendingPool struct {
+	mu     sync.Mutex
+	blocks []*pendingBlock
+}
+
+// Adds the block to the pool, unless it is there already. Returns false if
+// it was. mu must be held.
+func (pp *pendingPool) add(conn net.Conn, b block, missing []string, now time.Time) bool {
+	pp.expire(now)
+	for _, x := range pp.blocks {
+		if bytes.Equal(x.block.Shb, b.Shb) {
+			return false
+		}
+	}
+	if len(pp.blocks) >= maxPendingBlocks {
+		pp.blocks = pp.blocks[1:]
+	}
+
+	pb := &pendingBlock{block: b, conn: conn, missing: make(map[string]bool), added: now}
+	for _, id := range missing {
+		pb.missing[id] = true
+	}
+	pp.blocks = append(pp.blocks, pb)
+	return true
+}
+
+// Marks the transaction as arrived, and removes and returns the blocks that
+// have all of their transactions now.
+func (pp *pendingPool) arrived(id string, now time.Time) []*pendingBlock {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.expire(now)
+
+	complete := []*pendingBlock{}
+	kept := pp.blocks[:0]
+	for _, x := range pp.blocks {
+		delete(x.missing, id)
+		if len(x.missing) == 0 {
+			complete = append(complete, x)
+		} else {
+			kept = append(kept, x)
+		}
+	}
+	pp.blocks = kept
+	return complete
+}
+
+func (pp *pendingPool) len() int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return len(pp.blocks)
+}
+
+// Blocks are added in order, so the oldest come first. mu must be held.
+func (pp *pendingPool) expire(now time.Time) {
+	i := 0
+	for i < len(pp.blocks) && now.Sub(pp.blocks[i].added) >= pendingExpiry {
+		i++
+	}
+	pp.blocks = pp.blocks[i:]
+}
+
+// Returns the ids we have no transaction for.
+func (p *Peer) missingTransactions(ids []string) []string {
+	p.transactionsMu.RLock()
+	defer p.transactionsMu.RUnlock()
+	missing := []string{}
+	for _, id := range ids {
+		if _, ok := p.transactions[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+// Keeps the block pending if we are missing some of its transactions, and
+// asks for them. Returns false if we have them all.
+func (p *Peer) holdBlock(conn net.Conn, b block) bool {
+	// Checked while the pool is held, so a transaction that arrives now
+	// finds the block in it
+	p.pending.mu.Lock()
+	missing := p.missingTransactions(b.Transactions)
+	if len(missing) == 0 {
+		p.pending.mu.Unlock()
+		return false
+	}
+	added := p.pending.add(conn, b, missing, time.Now())
+	p.pending.mu.Unlock()
+
+	if !added {
+		return true
+	}
+	fmt.Printf("%s holds block of slot %d until %d of its transactions arrive\n", p.info.Alias, b.Slot, len(missing))
+
+	// A replayed peer has nobody to ask, and gets the transactions from the
+	// recording if the recorded peer got them flooded
+	if !p.replaying {
+		p.spawn(func() {
+			p.fetchTransactions(conn, missing)
+		})
+	}
+	return true
+}
+
+// Adds the blocks that were only waiting for the transaction.
+func (p *Peer) transactionArrived(id string) {
+	for _, pb := range p.pending.arrived(id, time.Now()) {
+		p.addBlock(pb.conn, pb.block)
+	}
+}
+
+func (p *Peer) sendGetTransactions(conn net.Conn, ids []string) ([]signedTransaction, error) {
+	var transactions []signedTransaction
+	err := p.rpc.Call(conn, "getTransactions", ids, &transactions, callTimeout)
+	return transactions, err
+}
+
+// Returns the transactions with the given ids that we have.
+func (p *Peer) receivedGetTransactions(conn net.Conn, ids []string) ([]signedTransaction, error) {
+	p.transactionsMu.RLock()
+	defer p.transactionsMu.RUnlock()
+	transactions := []signedTransaction{}
+	for _, id := range ids {
+		if st, ok := p.transactions[id]; ok {
+			transactions = append(transactions, st)
+		}
+	}
+	return transactions, nil
+}
+
+// Asks the peer for the transactions, and then our other neighbours for the
+// ones it does not have. Each is checked like a flooded transaction.
+func (p *Peer) fetchTransactions(conn net.Conn, ids []string) {
+	conns := []net.Conn{conn}
+	for _, c := range p.rpc.Connections() {
+		if c != conn {
+			conns = append(conns, c)
+		}
+	}
+
+	for _, c := range conns {
+		transactions, err := p.sendGetTransactions(c, ids)
+		if err != nil {
+			fmt.Printf("%s could not get transactions: %v\n", p.info.Alias, err)
+			continue
+		}
+		for _, st := range transactions {
+			if err := p.receivedSignedTransaction(c, st); err != nil {
+				fmt.Printf("%s got a bad transaction: %v\n", p.info.Alias, err)
+			}
+		}
+
+		ids = p.missingTransactions(ids)
+		if len(ids) == 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package dsys
+
+import (
+	"os"
+)
+
+// Records every frame the peer sends and receives to the file, from when the
+// peer starts until it is shut down. Must be called before Start.
+func (p *Peer) Record(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	p.recording = f
+	return nil
+}
+
+// Replays a recording made with Record into the peer, which must not have
+// been started. The peer goes through the same transactions, blocks and
+// branch switches as the recorded peer did, but without connections or a
+// slot loop of its own. If the recorded peer started from a genesis file, the
+// peer must use it too. Blocks the recorded peer synced when it joined are
+// streamed, so they are not replayed.
+func (p *Peer) Replay(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p.replaying = true
+	p.initializeTree()
+	p.initializeRPC()
+	p.initializeMetrics()
+	if p.initialGenesis != nil {
+		p.initializeGenesis(*p.initialGenesis)
+	}
+	return p.rpc.Replay(f)
+}
@@ -1,110 +1,205 @@
-package main
+package dsys
 
 import (
 	"dsys/rpc"
+	"errors"
 	"fmt"
 	"net"
+	"time"
 )
 
-// Should have matching send/receive for all RPCs
-
-func (p *peer) sendGetPeerInfoList(conn net.Conn) {
-	p.rpc.Send("getPeerInfoList", nil, conn, false)
-}
-
-func (p *peer) receivedGetPeerInfoList(conn net.Conn, b []byte) {
-	p.sendPeerInfoList(conn)
-}
+const (
+	// How long to wait for the reply to a call before giving up
+	callTimeout = 5 * time.Second
+	// The largest message we send or accept
+	maxMessageSize = 16 << 20
+	// How many messages a second a connection may send us on average, and
+	// at once. Syncing streams the chain as fast as we read it.
+	messageRate  = 1000
+	messageBurst = 10000
+	// Peers on other networks are refused
+	networkID = "dsys"
+)
 
-func (p *peer) sendPeerInfoList(conn net.Conn) {
-	p.rpc.Send("peerInfoList", p.peerInfoList, conn, false)
-}
+// The topics transactions and blocks are flooded in. Peers that are not
+// subscribed to a topic neither receive nor forward its messages.
+const (
+	transactionsTopic = "transactions"
+	blocksTopic       = "blocks"
+)
 
-func (p *peer) receivedPeerInfoList(conn net.Conn, b []byte) {
-	// If we already have a peer list
-	if len(p.peerInfoList) != 1 {
-		return
-	}
+// Should have matching send/receive for all RPCs
 
+func (p *Peer) sendGetPeerInfoList(conn net.Conn) ([]peerInfo, error) {
 	var peerInfoList []peerInfo
-	tryUnmarshal(b, &peerInfoList)
-
-	p.connectToPeers(peerInfoList)
+	err := p.rpc.Call(conn, "getPeerInfoList", nil, &peerInfoList, callTimeout)
+	return peerInfoList, err
+}
 
-	go p.listenForConnections()
+func (p *Peer) receivedGetPeerInfoList(conn net.Conn, _ struct{}) ([]peerInfo, error) {
+	p.peerInfoListMu.Lock()
+	defer p.peerInfoListMu.Unlock()
+	return append([]peerInfo{}, p.peerInfoList...), nil
 }
 
-func (p *peer) broadcastPresence(info peerInfo) {
+func (p *Peer) broadcastPresence(info peerInfo) {
 	p.rpc.Send("presence", info, nil, true)
 }
 
-func (p *peer) receivedPresence(conn net.Conn, b []byte) {
-	var info peerInfo
-	tryUnmarshal(b, &info)
-
-	p.addToPeerInfoList(info)
-	p.ledger.addAccount(info.Alias, info.Pk)
+func (p *Peer) receivedPresence(conn net.Conn, info peerInfo) error {
+	added, err := p.addPeer(info)
+	if errors.Is(err, ErrAliasTaken) {
+		// The sender may not know the peer the alias is bound to
+		return fmt.Errorf("%w: %v", rpc.ErrNotForwarded, err)
+	}
+	if err != nil {
+		fmt.Printf("%s could not verify presence of %s...\n", p.info.Alias, info.Alias)
+		return err
+	}
+	// Anti-entropy can repeat presences we already got with the peer list
+	if !added {
+		return nil
+	}
+	p.events.publish(Event{
+		Kind: PeerJoined,
+		Peer: &PeerInfo{
+			Alias:   info.Alias,
+			Address: info.Address,
+			Account: encodePk(info.Pk),
+		},
+	})
+	return nil
 }
 
-func (p *peer) broadcastSignedTransaction(st signedTransaction) {
+func (p *Peer) broadcastSignedTransaction(st signedTransaction) {
 	p.rpc.Send("transaction", st, nil, true)
 }
 
-func (p *peer) receivedSignedTransaction(conn net.Conn, b []byte) {
-	var st signedTransaction
-	tryUnmarshal(b, &st)
-
+func (p *Peer) receivedSignedTransaction(conn net.Conn, st signedTransaction) error {
 	t := st.Transaction
 
+	// Returning an error stops the transaction from being flooded on and
+	// penalizes the sender
 	pk, err := decodePk(t.From)
 	if err != nil {
-		return
+		return err
 	}
 
 	if !verifySignature(pk, st.Signature, t) {
 		fmt.Printf("%s could not verify transaction signature...\n", p.info.Alias)
-		return
+		return ErrBadSignature
 	}
 
-	p.addTransaction(t)
-	p.addToQueue(t.ID)
+	// A transaction we have is queued or chained already
+	p.addTransaction(st, true)
+	return nil
 }
 
-func (p *peer) BroadcastGenesis(g genesis) {
+func (p *Peer) BroadcastGenesis(g genesis) {
 	p.rpc.Send("genesis", g, nil, true)
 }
 
-func (p *peer) receivedGenesis(conn net.Conn, b []byte) {
-	var g genesis
-	tryUnmarshal(b, &g)
-
+func (p *Peer) receivedGenesis(conn net.Conn, g genesis) {
 	p.initializeGenesis(g)
 }
 
-func (p *peer) BroadcastBlock(b block) {
+func (p *Peer) BroadcastBlock(b block) {
 	p.rpc.Send("block", b, nil, true)
 }
 
-func (p *peer) receivedBlock(conn net.Conn, b []byte) {
-	var block block
-	tryUnmarshal(b, &block)
+func (p *Peer) receivedBlock(conn net.Conn, b block) error {
+	p.blockEvent(BlockReceived, b, nil)
+	if b.Pk == nil {
+		p.blockEvent(BlockRejected, b, ErrBadKey)
+		return ErrBadKey
+	}
+
+	// Unlike the lottery, the block signature does not depend on our view of
+	// the chain, so only a bad signature is the sender's fault
+	if !verifySignature(b.Pk, b.Shb, b.Ph, b.Transactions) {
+		fmt.Printf("%s could not verify block signature...\n", p.info.Alias)
+		p.blockEvent(BlockRejected, b, ErrBadSignature)
+		return ErrBadSignature
+	}
+
+	if !p.verifyDraw(b) {
+		p.blockEvent(BlockRejected, b, ErrInvalidDraw)
+		return fmt.Errorf("%w: %v", rpc.ErrNotForwarded, ErrInvalidDraw)
+	}
+
+	return p.addBlock(conn, b)
+}
 
-	if !p.verifyBlock(block) {
-		return
+// Adds a checked block to the tree if its draw wins at its parent, and then
+// the orphans that waited for it. A block is held until we have its
+// transactions, and a block whose parent we do not have becomes an orphan.
+// The parent may be on its way, or we may have rejected it ourselves, so
+// neither is the sender's fault. Returns rpc.ErrNotForwarded unless the
+// block was added, so blocks we could not check are not flooded on.
+func (p *Peer) addBlock(conn net.Conn, b block) error {
+	if p.holdBlock(conn, b) {
+		return fmt.Errorf("%w: block of slot %d waits for its transactions", rpc.ErrNotForwarded, b.Slot)
 	}
 
-	p.removeFromQueue(block.Transactions...)
-	p.tree.insert(block.Slot, block.Transactions, block.Ps, block.Ph)
-	p.payWinner(block)
+	p.treeMu.Lock()
+	// A block we synced or fetched may also be flooded to us
+	if p.knownBlock(b) {
+		p.treeMu.Unlock()
+		return fmt.Errorf("%w: block of slot %d is known", rpc.ErrNotForwarded, b.Slot)
+	}
+	// Our view of the chain may differ from the sender's, but not our view of
+	// the chain up to the parent
+	if parent, err := p.tree.findParent(b.Ps, b.Ph); err == nil && !aboveHardness(p.computeValue(b.Draw, *b.Pk, parent)) {
+		p.treeMu.Unlock()
+		p.blockEvent(BlockRejected, b, ErrInvalidDraw)
+		return fmt.Errorf("%w: %v", rpc.ErrNotForwarded, ErrInvalidDraw)
+	}
+	head := p.tree.current
+	n, err := p.tree.insert(b.Slot, b.Transactions, b.Ps, b.Ph, b.Pk)
+	var hash []byte
+	if err == nil {
+		p.blocks[n] = b
+		hash = n.hash()
+		p.observeTree()
+		p.blockAddedEvents(n, head)
+	}
+	p.treeMu.Unlock()
+
+	if errors.Is(err, ErrUnknownParent) {
+		p.addOrphan(conn, b)
+		return fmt.Errorf("%w: block of slot %d waits for its parent", rpc.ErrNotForwarded, b.Slot)
+	}
+	if err != nil {
+		fmt.Printf("%s dropped block of slot %d: %v\n", p.info.Alias, b.Slot, err)
+		p.blockEvent(BlockRejected, b, err)
+		return fmt.Errorf("%w: %v", rpc.ErrNotForwarded, err)
+	}
+	p.removeFromQueue(b.Transactions...)
+	for _, orphan := range p.orphans.take(b.Slot, hash, time.Now()) {
+		p.addBlock(conn, orphan)
+	}
+	return nil
 }
 
-func (p *peer) makeRpc() *rpc.Rpc {
+func (p *Peer) makeRpc() *rpc.Rpc {
 	r := rpc.MakeRpc(p.info.Alias, false)
+	r.SetTransport(p.transport)
+	r.SetNetwork(networkID)
+	r.SetAntiEntropy(antiEntropyInterval)
+	r.EnableEncryption(p.sk)
+	r.OnDisconnect(p.disconnectedFrom)
+	r.Use(rpc.Recover(), rpc.MaxSize(maxMessageSize), rpc.RateLimit(messageRate, messageBurst))
 	r.RegisterFunction("presence", p.receivedPresence, true)
 	r.RegisterFunction("transaction", p.receivedSignedTransaction, true)
-	r.RegisterFunction("getPeerInfoList", p.receivedGetPeerInfoList, false)
-	r.RegisterFunction("peerInfoList", p.receivedPeerInfoList, false)
+	r.RegisterCallable("getPeerInfoList", p.receivedGetPeerInfoList, false)
 	r.RegisterFunction("genesis", p.receivedGenesis, true)
 	r.RegisterFunction("block", p.receivedBlock, true)
+	r.RegisterCallable("getChainInfo", p.receivedGetChainInfo, false)
+	r.RegisterStream("getBlocks", p.receivedGetBlocks)
+	r.RegisterCallable("getBlock", p.receivedGetBlock, false)
+	r.RegisterCallable("getTransactions", p.receivedGetTransactions, false)
+	r.SetTopic("transaction", transactionsTopic)
+	r.SetTopic("block", blocksTopic)
+	r.Subscribe(transactionsTopic, blocksTopic)
 	return &r
 }
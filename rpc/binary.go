@@ -0,0 +1,336 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+)
+
+/*
+	A compact binary codec. Values are written without field names or type
+	information, so both sides must decode into the same type they encoded.
+
+	Integers are varints, strings and big integers are prefixed with their
+	length, slices with their length plus one so that nil slices are kept apart
+	from empty ones, pointers are prefixed with a byte telling if they are nil,
+	and structs are their exported fields in order.
+*/
+
+var errBinaryUnsupported = errors.New("rpc: binary codec does not support type")
+
+var bigIntType = reflect.TypeOf(big.Int{})
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string { return "binary" }
+
+// Pointers to the value are followed, like JSON and Gob do, so a value can be
+// sent as a pointer and received as a value.
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+
+	var buf bytes.Buffer
+	if err := encodeBinary(&buf, rv); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (binaryCodec) Unmarshal(b []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("rpc: binary codec needs a non-nil pointer to decode into")
+	}
+	rv = rv.Elem()
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+
+	reader := bytes.NewReader(b)
+	if err := decodeBinary(reader, rv); err != nil {
+		return err
+	}
+	if reader.Len() != 0 {
+		return errors.New("rpc: binary codec found trailing bytes")
+	}
+	return nil
+}
+
+func encodeBinary(buf *bytes.Buffer, v reflect.Value) error {
+	if v.Type() == bigIntType {
+		var i *big.Int
+		if v.CanAddr() {
+			i = v.Addr().Interface().(*big.Int)
+		} else {
+			x := v.Interface().(big.Int)
+			i = &x
+		}
+		buf.WriteByte(byte(i.Sign() + 1))
+		writeBytes(buf, i.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeVarint(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeUvarint(buf, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(v.Float()))
+		buf.Write(b[:])
+	case reflect.String:
+		writeBytes(buf, []byte(v.String()))
+	case reflect.Slice:
+		if v.IsNil() {
+			writeUvarint(buf, 0)
+			return nil
+		}
+		writeUvarint(buf, uint64(v.Len())+1)
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf.Write(v.Bytes())
+			return nil
+		}
+		return encodeElements(buf, v)
+	case reflect.Array:
+		return encodeElements(buf, v)
+	case reflect.Map:
+		return encodeMap(buf, v)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			if err := encodeBinary(buf, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteByte(0)
+			return nil
+		}
+		buf.WriteByte(1)
+		return encodeBinary(buf, v.Elem())
+	default:
+		return fmt.Errorf("%w %v", errBinaryUnsupported, v.Type())
+	}
+	return nil
+}
+
+func encodeElements(buf *bytes.Buffer, v reflect.Value) error {
+	for i := 0; i < v.Len(); i++ {
+		if err := encodeBinary(buf, v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Maps are written sorted by their encoded keys, so equal maps are encoded
+// into equal bytes.
+func encodeMap(buf *bytes.Buffer, v reflect.Value) error {
+	type entry struct{ key, value []byte }
+	entries := make([]entry, 0, v.Len())
+
+	iter := v.MapRange()
+	for iter.Next() {
+		var key, value bytes.Buffer
+		if err := encodeBinary(&key, iter.Key()); err != nil {
+			return err
+		}
+		if err := encodeBinary(&value, iter.Value()); err != nil {
+			return err
+		}
+		entries = append(entries, entry{key.Bytes(), value.Bytes()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+
+	writeUvarint(buf, uint64(len(entries)))
+	for _, e := range entries {
+		buf.Write(e.key)
+		buf.Write(e.value)
+	}
+	return nil
+}
+
+func decodeBinary(reader *bytes.Reader, v reflect.Value) error {
+	if v.Type() == bigIntType {
+		sign, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		b, err := readBytes(reader)
+		if err != nil {
+			return err
+		}
+		i := v.Addr().Interface().(*big.Int)
+		i.SetBytes(b)
+		if sign == 0 {
+			i.Neg(i)
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		v.SetBool(b != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := binary.ReadVarint(reader)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return err
+		}
+		v.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		var b [8]byte
+		if _, err := io.ReadFull(reader, b[:]); err != nil {
+			return err
+		}
+		v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(b[:])))
+	case reflect.String:
+		b, err := readBytes(reader)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		n, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if n-1 > uint64(reader.Len()) {
+			return io.ErrUnexpectedEOF
+		}
+		v.Set(reflect.MakeSlice(v.Type(), int(n-1), int(n-1)))
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			_, err := io.ReadFull(reader, v.Bytes())
+			return err
+		}
+		return decodeElements(reader, v)
+	case reflect.Array:
+		return decodeElements(reader, v)
+	case reflect.Map:
+		n, err := readLength(reader)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.MakeMapWithSize(v.Type(), n))
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := decodeBinary(reader, key); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeBinary(reader, value); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			if err := decodeBinary(reader, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+		return decodeBinary(reader, v.Elem())
+	default:
+		return fmt.Errorf("%w %v", errBinaryUnsupported, v.Type())
+	}
+	return nil
+}
+
+func decodeElements(reader *bytes.Reader, v reflect.Value) error {
+	for i := 0; i < v.Len(); i++ {
+		if err := decodeBinary(reader, v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeVarint(buf *bytes.Buffer, i int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], i)])
+}
+
+func writeUvarint(buf *bytes.Buffer, i uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], i)])
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+// Reads a length and checks that it can not be more than the bytes left, so a
+// malicious length can not make us allocate a huge slice.
+func readLength(reader *bytes.Reader) (int, error) {
+	n, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(reader.Len()) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return int(n), nil
+}
+
+func readBytes(reader *bytes.Reader) ([]byte, error) {
+	n, err := readLength(reader)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,96 @@
+package rpc
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Remembers the ids of recently flooded messages. Holds at most size ids, and
+// forgets ids older than age.
+type floodCache struct {
+	mu      sync.Mutex
+	entries map[uint64]*list.Element
+	order   *list.List // oldest first
+	size    int
+	age     time.Duration
+
+	hits   uint64
+	misses uint64
+}
+
+type floodEntry struct {
+	id   uint64
+	seen time.Time
+}
+
+// Statistics about the flood cache.
+type FloodStats struct {
+	Hits   uint64 // Messages dropped because they had already been seen
+	Misses uint64 // Messages seen for the first time
+	Size   int    // Ids currently remembered
+}
+
+func makeFloodCache(size int, age time.Duration) *floodCache {
+	return &floodCache{
+		entries: make(map[uint64]*list.Element),
+		order:   list.New(),
+		size:    size,
+		age:     age,
+	}
+}
+
+// Adds the id to the cache. Returns true if it was already there.
+func (c *floodCache) seen(id uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+
+	if _, ok := c.entries[id]; ok {
+		c.hits++
+		return true
+	}
+	c.misses++
+
+	c.entries[id] = c.order.PushBack(floodEntry{id: id, seen: now})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Front())
+	}
+	return false
+}
+
+// Returns true if the id is in the cache, without adding it.
+func (c *floodCache) has(id uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(time.Now())
+	_, ok := c.entries[id]
+	return ok
+}
+
+// Removes the ids that are older than the maximum age.
+func (c *floodCache) expire(now time.Time) {
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		if now.Sub(e.Value.(floodEntry).seen) < c.age {
+			return
+		}
+		c.remove(e)
+	}
+}
+
+func (c *floodCache) remove(e *list.Element) {
+	delete(c.entries, e.Value.(floodEntry).id)
+	c.order.Remove(e)
+}
+
+func (c *floodCache) stats() FloodStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return FloodStats{
+		Hits:   c.hits,
+		Misses: c.misses,
+		Size:   c.order.Len(),
+	}
+}
@@ -0,0 +1,160 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+)
+
+// Reserved function names used to answer a call.
+const (
+	replyFunction = "_reply"
+	errorFunction = "_error"
+)
+
+var ErrConnectionClosed = errors.New("rpc: connection closed")
+
+// The error returned by a call when the remote handler failed.
+type RemoteError string
+
+func (e RemoteError) Error() string {
+	return "rpc: remote error: " + string(e)
+}
+
+type call struct {
+	done chan reply
+}
+
+// Calls are numbered by us, but a reply is only taken from the connection
+// the call was sent on, so no other peer can answer it.
+type callKey struct {
+	conn net.Conn
+	id   uint64
+}
+
+type reply struct {
+	message message
+	err     error
+}
+
+// Sends the given function with the given payload to the connection and waits
+// for the reply, which is decoded into result. Returns an error if no reply
+// arrives within the timeout.
+func (r *Rpc) Call(conn net.Conn, function string, payload interface{}, result interface{}, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return r.CallContext(ctx, conn, function, payload, result)
+}
+
+// Like Call, but waits until the reply arrives or the context is done.
+func (r *Rpc) CallContext(ctx context.Context, conn net.Conn, function string, payload interface{}, result interface{}) error {
+	c := &call{
+		done: make(chan reply, 1),
+	}
+
+	r.pendingMu.Lock()
+	r.nextID++
+	id := r.nextID
+	r.pending[callKey{conn, id}] = c
+	r.pendingMu.Unlock()
+
+	defer r.removePending(conn, id)
+
+	b, err := encodeMessage(r.codecFor(conn), function, id, payload)
+	if err != nil {
+		return err
+	}
+	if err := r.send(conn, b); err != nil {
+		return err
+	}
+
+	select {
+	case rep := <-c.done:
+		if rep.err != nil {
+			return rep.err
+		}
+		return rep.message.decode(result)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Runs the handler of a call and sends its result back to the caller, using
+// the codec the call was encoded with.
+func (r *Rpc) answer(conn net.Conn, m message, h handler, arg reflect.Value) {
+	// Calls run on their own goroutine, so a panic is answered here rather
+	// than caught by the middlewares
+	defer func() {
+		if v := recover(); v != nil {
+			b, _ := encodeMessage(m.codec, errorFunction, m.id, fmt.Sprint("handler panicked: ", v))
+			r.SendRaw(b, conn)
+		}
+	}()
+
+	result, err := h.call(conn, arg)
+	if err == nil {
+		b, encodeErr := encodeMessage(m.codec, replyFunction, m.id, result)
+		if encodeErr == nil {
+			r.SendRaw(b, conn)
+			return
+		}
+		err = encodeErr
+	}
+
+	b, _ := encodeMessage(m.codec, errorFunction, m.id, err.Error())
+	r.SendRaw(b, conn)
+}
+
+// Hands a reply received on the connection to the call that is waiting for
+// it. Returns an error if the reply answers a call made to another peer, or
+// one never made.
+func (r *Rpc) resolve(conn net.Conn, id uint64, rep reply) error {
+	r.pendingMu.Lock()
+	c, ok := r.pending[callKey{conn, id}]
+	delete(r.pending, callKey{conn, id})
+	forged := !ok && (id > r.nextID || r.pendingElsewhere(id))
+	r.pendingMu.Unlock()
+	if forged {
+		return fmt.Errorf("%w: reply %d to a call not made on the connection", ErrMalformedFrame, id)
+	}
+	if !ok {
+		// The call timed out before the reply arrived
+		r.log("%s received reply %d which nobody is waiting for", r.alias, id)
+		return nil
+	}
+
+	c.done <- rep
+	return nil
+}
+
+// Reports whether a call with the id waits for a reply on any connection.
+// pendingMu must be held.
+func (r *Rpc) pendingElsewhere(id uint64) bool {
+	for key := range r.pending {
+		if key.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rpc) removePending(conn net.Conn, id uint64) {
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	delete(r.pending, callKey{conn, id})
+}
+
+// Fails every call that is waiting for a reply on the given connection.
+func (r *Rpc) failPending(conn net.Conn, err error) {
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	for key, c := range r.pending {
+		if key.conn == conn {
+			c.done <- reply{err: err}
+			delete(r.pending, key)
+		}
+	}
+}
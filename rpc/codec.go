@@ -0,0 +1,87 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// A Codec encodes and decodes the payloads of rpc messages.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+var (
+	JSON   Codec = jsonCodec{}
+	Gob    Codec = gobCodec{}
+	Binary Codec = binaryCodec{}
+)
+
+// The codec of a frame is identified by its index in this list, so codecs must
+// only ever be appended.
+var codecs = []Codec{JSON, Gob, Binary}
+
+func codecID(c Codec) byte {
+	for i, x := range codecs {
+		if x.Name() == c.Name() {
+			return byte(i)
+		}
+	}
+	panic("rpc: unknown codec " + c.Name())
+}
+
+func codecByID(id byte) (Codec, error) {
+	if int(id) >= len(codecs) {
+		return nil, fmt.Errorf("%w: unknown codec %d", ErrMalformedFrame, id)
+	}
+	return codecs[id], nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+// Note that gob decodes empty slices as nil.
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+// Encodes a payload. A nil payload is encoded as no bytes at all, since not
+// every codec can encode nil.
+func marshalPayload(c Codec, v interface{}) ([]byte, error) {
+	if v == nil {
+		return []byte{}, nil
+	}
+	return c.Marshal(v)
+}
+
+// Decodes a payload into v. An empty payload leaves v untouched.
+func unmarshalPayload(c Codec, b []byte, v interface{}) error {
+	if len(b) == 0 || v == nil {
+		return nil
+	}
+	return c.Unmarshal(b, v)
+}
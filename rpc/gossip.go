@@ -0,0 +1,247 @@
+package rpc
+
+import (
+	"container/list"
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	Flooded messages are pushed to every connection, or to a random subset of
+	them if the function has a fanout, but never back to where they came from.
+	Since a fanout can leave some peers without a message, anti-entropy repairs
+	the gaps: every interval we send the ids of the messages we have recently
+	seen to a random neighbour, which asks for the ones it is missing.
+
+	The random choices, and the ids of flooded messages, come from one source.
+	It draws from crypto/rand, so ids can not be guessed, unless the handler
+	runs on the in-memory network, which seeds it so runs can be reproduced.
+*/
+
+const (
+	digestFunction = "_digest"
+	wantFunction   = "_want"
+
+	defaultRecentSize = 1000
+	defaultRecentAge  = time.Minute
+)
+
+// Sets how many random connections flooded messages of the function are
+// pushed to. A fanout of 0 pushes to all connections.
+func (r *Rpc) SetFanout(function string, fanout int) {
+	r.fanout[function] = fanout
+}
+
+// Sets the source of the random choices of the handler and of the ids of
+// flooded messages. Ids drawn from a seeded source can be guessed by others.
+func (r *Rpc) SetRand(rng *rand.Rand) {
+	r.randMu.Lock()
+	defer r.randMu.Unlock()
+	r.rand = rng
+}
+
+// A source that draws from crypto/rand.
+type cryptoSource struct{}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	crand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func (s cryptoSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (cryptoSource) Seed(int64) {}
+
+// Returns a random id for a flooded message. 0 is reserved for messages that
+// are not flooded.
+func (r *Rpc) newFloodID() uint64 {
+	r.randMu.Lock()
+	defer r.randMu.Unlock()
+	for {
+		if id := r.rand.Uint64(); id != 0 {
+			return id
+		}
+	}
+}
+
+// Sets how often a digest of recently flooded messages is sent to a random
+// connection once the handler is started. An interval of 0 turns it off.
+func (r *Rpc) SetAntiEntropy(interval time.Duration) {
+	r.antiEntropy = interval
+}
+
+func (r *Rpc) antiEntropyLoop() {
+	ticker := time.NewTicker(r.antiEntropy)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.closing:
+			return
+		case <-ticker.C:
+			r.sendDigest()
+		}
+	}
+}
+
+// Returns the connections a flooded message of the function is pushed to,
+// never including the connection it came from or connections that are not
+// interested in the function.
+func (r *Rpc) floodTargets(function string, from net.Conn) []net.Conn {
+	conns := r.interestedIn(function)
+	for i, conn := range conns {
+		if conn == from {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+
+	k := r.fanout[function]
+	if k == 0 || k >= len(conns) {
+		return conns
+	}
+	r.randMu.Lock()
+	r.rand.Shuffle(len(conns), func(i, j int) {
+		conns[i], conns[j] = conns[j], conns[i]
+	})
+	r.randMu.Unlock()
+	return conns[:k]
+}
+
+// Pushes an encoded flooded frame on to its targets.
+func (r *Rpc) flood(function string, b []byte, from net.Conn) {
+	for _, conn := range r.floodTargets(function, from) {
+		r.send(conn, b)
+	}
+}
+
+func (r *Rpc) sendDigest() {
+	conns := r.Connections()
+	if len(conns) == 0 {
+		return
+	}
+	r.randMu.Lock()
+	conn := conns[r.rand.Intn(len(conns))]
+	r.randMu.Unlock()
+
+	ids := r.recent.ids(func(function string) bool {
+		return r.interested(conn, function)
+	})
+	if len(ids) > 0 {
+		r.Send(digestFunction, ids, conn, false)
+	}
+}
+
+// Asks for the messages in the digest we have not seen.
+func (r *Rpc) receivedDigest(conn net.Conn, m message) {
+	var ids []uint64
+	if err := m.decode(&ids); err != nil {
+		return
+	}
+
+	missing := []uint64{}
+	for _, id := range ids {
+		if !r.flooded.has(id) {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		r.Send(wantFunction, missing, conn, false)
+	}
+}
+
+// Sends the messages that were asked for, if we still have them.
+func (r *Rpc) receivedWant(conn net.Conn, m message) {
+	var ids []uint64
+	if err := m.decode(&ids); err != nil {
+		return
+	}
+
+	for _, id := range ids {
+		if b, ok := r.recent.get(id); ok && r.interested(conn, frameFunction(b)) {
+			r.send(conn, b)
+		}
+	}
+}
+
+// Keeps the frames of recently flooded messages, so they can be sent to peers
+// that missed them. Holds at most size frames, none older than age.
+type messageStore struct {
+	mu      sync.Mutex
+	entries map[uint64]*list.Element
+	order   *list.List // oldest first
+	size    int
+	age     time.Duration
+}
+
+type storedMessage struct {
+	id    uint64
+	frame []byte
+	added time.Time
+}
+
+func makeMessageStore(size int, age time.Duration) *messageStore {
+	return &messageStore{
+		entries: make(map[uint64]*list.Element),
+		order:   list.New(),
+		size:    size,
+		age:     age,
+	}
+}
+
+func (s *messageStore) add(id uint64, frame []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[id]; ok {
+		return
+	}
+	s.entries[id] = s.order.PushBack(storedMessage{id: id, frame: frame, added: time.Now()})
+	for s.order.Len() > s.size {
+		s.remove(s.order.Front())
+	}
+}
+
+func (s *messageStore) get(id uint64) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[id]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(storedMessage).frame, true
+}
+
+// Returns the ids of the stored messages, after forgetting the old ones.
+// Returns the ids of the messages whose function passes the filter.
+func (s *messageStore) ids(filter func(function string) bool) []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for e := s.order.Front(); e != nil; e = s.order.Front() {
+		if now.Sub(e.Value.(storedMessage).added) < s.age {
+			break
+		}
+		s.remove(e)
+	}
+
+	ids := make([]uint64, 0, s.order.Len())
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		if m := e.Value.(storedMessage); filter(frameFunction(m.frame)) {
+			ids = append(ids, m.id)
+		}
+	}
+	return ids
+}
+
+func (s *messageStore) remove(e *list.Element) {
+	delete(s.entries, e.Value.(storedMessage).id)
+	s.order.Remove(e)
+}
@@ -0,0 +1,233 @@
+package rpc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	helloFunction    = "_hello"
+	handshakeTimeout = 5 * time.Second
+	nonceSize        = 32
+)
+
+// The version of the protocol spoken by this package, and the oldest version
+// it can still talk to.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+var (
+	ErrNoCommonCodec      = errors.New("rpc: no common codec")
+	ErrEncryptionMismatch = errors.New("rpc: only one side of the connection wants encryption")
+	ErrIncompatible       = errors.New("rpc: incompatible peer")
+	ErrUnsupported        = errors.New("rpc: function is not supported by the peer")
+)
+
+// The first message sent on every connection. It is always encoded as JSON, and
+// fields may only be added to it, so every version can read it.
+type hello struct {
+	Version    int
+	MinVersion int
+	Network    string
+	Genesis    []byte   // Only set once the chain has started
+	Functions  []string // The functions we have registered
+	Topics     []string // The topics we are subscribed to, nil if we do not know topics
+	Codecs     []string
+	Pk         *rsa.PublicKey // Only set if encryption is enabled
+	Nonce      []byte
+}
+
+// Sets the network we are part of. Peers of other networks are refused.
+func (r *Rpc) SetNetwork(network string) {
+	r.identityMu.Lock()
+	defer r.identityMu.Unlock()
+	r.network = network
+}
+
+// Sets the hash of the genesis of our chain. Once both sides of a connection
+// have one, peers with a different genesis are refused.
+func (r *Rpc) SetGenesis(hash []byte) {
+	r.identityMu.Lock()
+	defer r.identityMu.Unlock()
+	r.genesis = hash
+}
+
+// Returns whether the peer on the connection has registered the function, and
+// so may be sent it.
+func (r *Rpc) Supports(conn net.Conn, function string) bool {
+	if strings.HasPrefix(function, "_") {
+		return true
+	}
+	r.connsMu.RLock()
+	defer r.connsMu.RUnlock()
+	c, ok := r.conns[conn]
+	return ok && c.functions[function]
+}
+
+// Exchanges hellos with the other side of the connection, and authenticates
+// it if encryption is enabled. Returns the state to keep about the connection.
+func (r *Rpc) handshake(conn net.Conn) (*connection, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	ours := r.hello()
+	if r.sk != nil {
+		ours.Pk = &r.sk.PublicKey
+		ours.Nonce = make([]byte, nonceSize)
+		if _, err := rand.Read(ours.Nonce); err != nil {
+			return nil, err
+		}
+	}
+
+	var theirs hello
+	if err := exchange(conn, helloFunction, ours, &theirs); err != nil {
+		return nil, err
+	}
+
+	// Both sides run the same checks on the same hellos, so both refuse the
+	// connection for the same reason
+	if err := compatible(ours, theirs); err != nil {
+		return nil, err
+	}
+
+	codec, err := r.chooseCodec(theirs.Codecs)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &connection{
+		stop:      make(chan struct{}),
+		codec:     codec,
+		wire:      conn,
+		queue:     make(chan []byte, r.queueSize),
+		drain:     make(chan struct{}),
+		drained:   make(chan struct{}),
+		functions: make(map[string]bool),
+	}
+	for _, function := range theirs.Functions {
+		c.functions[function] = true
+	}
+	if theirs.Topics != nil {
+		c.topics = make(map[string]bool)
+		for _, topic := range theirs.Topics {
+			c.topics[topic] = true
+		}
+	}
+
+	if (ours.Pk == nil) != (theirs.Pk == nil) {
+		return nil, ErrEncryptionMismatch
+	}
+	if ours.Pk != nil {
+		c.wire, err = r.authenticate(conn, ours, theirs)
+		if err != nil {
+			return nil, err
+		}
+		c.pk = theirs.Pk
+	}
+
+	return c, nil
+}
+
+// Returns the hello describing us, without the key and nonce.
+func (r *Rpc) hello() hello {
+	r.identityMu.RLock()
+	defer r.identityMu.RUnlock()
+
+	h := hello{
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Network:    r.network,
+		Genesis:    r.genesis,
+		Codecs:     make([]string, len(r.codecs)),
+		Topics:     r.Subscriptions(),
+	}
+	for i, c := range r.codecs {
+		h.Codecs[i] = c.Name()
+	}
+	for function := range r.fns {
+		h.Functions = append(h.Functions, function)
+	}
+	sort.Strings(h.Functions)
+	return h
+}
+
+// Returns why the two sides of a connection cannot talk to each other, or nil
+// if they can.
+func compatible(ours hello, theirs hello) error {
+	if theirs.Version < ours.MinVersion || ours.Version < theirs.MinVersion {
+		return fmt.Errorf("%w: protocol version %d, we speak %d to %d", ErrIncompatible, theirs.Version, ours.MinVersion, ours.Version)
+	}
+	if theirs.Network != ours.Network {
+		return fmt.Errorf("%w: network %q, we are on %q", ErrIncompatible, theirs.Network, ours.Network)
+	}
+	if ours.Genesis != nil && theirs.Genesis != nil && !bytes.Equal(ours.Genesis, theirs.Genesis) {
+		return fmt.Errorf("%w: genesis %s, ours is %s", ErrIncompatible, shortHash(theirs.Genesis), shortHash(ours.Genesis))
+	}
+	return nil
+}
+
+func shortHash(hash []byte) string {
+	if len(hash) > 8 {
+		hash = hash[:8]
+	}
+	return hex.EncodeToString(hash)
+}
+
+// Sends the value as the given function on the connection and decodes the
+// same function from the other side into result. Both sides send first, so
+// the write happens concurrently with the read.
+func exchange(conn net.Conn, function string, v interface{}, result interface{}) error {
+	b, err := encodeMessage(JSON, function, 0, v)
+	if err != nil {
+		return err
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(b)
+		written <- err
+	}()
+
+	frame, err := readFrame(conn)
+	if err != nil {
+		return fmt.Errorf("rpc: handshake: %w", err)
+	}
+	if err := <-written; err != nil {
+		return fmt.Errorf("rpc: handshake: %w", err)
+	}
+
+	m, err := decodeFrame(frame)
+	if err != nil {
+		return err
+	}
+	if m.function != function {
+		return fmt.Errorf("rpc: handshake: expected %s but received %s", function, m.function)
+	}
+
+	if err := m.decode(result); err != nil {
+		return fmt.Errorf("rpc: handshake: %w", err)
+	}
+	return nil
+}
+
+// Returns our most preferred codec that the other side also supports.
+func (r *Rpc) chooseCodec(names []string) (Codec, error) {
+	for _, c := range r.codecs {
+		for _, name := range names {
+			if c.Name() == name {
+				return c, nil
+			}
+		}
+	}
+	return nil, ErrNoCommonCodec
+}
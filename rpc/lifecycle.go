@@ -0,0 +1,226 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// How a broken outbound connection is dialed again. The delay between
+// attempts doubles every time, up to the maximum.
+type redialPolicy struct {
+	delay    time.Duration
+	maxDelay time.Duration
+	attempts int
+}
+
+var defaultRedialPolicy = redialPolicy{
+	delay:    100 * time.Millisecond,
+	maxDelay: 30 * time.Second,
+	attempts: 10,
+}
+
+// How long Start gives Shutdown when its context is done.
+const shutdownTimeout = 5 * time.Second
+
+var ErrShutdown = errors.New("rpc: shut down")
+
+// Starts the background work of the RPC handler, and shuts it down when the
+// context is done.
+func (r *Rpc) Start(ctx context.Context) {
+	if r.antiEntropy > 0 {
+		r.spawn(r.antiEntropyLoop)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			r.Shutdown(ctx)
+		case <-r.closing:
+		}
+	}()
+}
+
+// Stops the RPC handler gracefully. New connections and calls are refused,
+// the calls and streams being handled are waited for, the outbound queues are
+// written and then every connection is closed. Returns when all goroutines of
+// the handler have stopped. If the context is done first, the rest is done
+// without waiting, and the error of the context is returned.
+func (r *Rpc) Shutdown(ctx context.Context) error {
+	r.lifeMu.Lock()
+	r.stopped = true
+	r.lifeMu.Unlock()
+	r.closeOnce.Do(func() {
+		close(r.closing)
+	})
+
+	err := wait(ctx, &r.handlers)
+
+	r.connsMu.RLock()
+	conns := make(map[net.Conn]*connection, len(r.conns))
+	for conn, c := range r.conns {
+		conns[conn] = c
+	}
+	r.connsMu.RUnlock()
+
+	for _, c := range conns {
+		c.drainOnce.Do(func() {
+			close(c.drain)
+		})
+	}
+	for conn, c := range conns {
+		select {
+		case <-c.drained:
+		case <-ctx.Done():
+		}
+		r.disconnect(conn, nil)
+	}
+
+	if loopsErr := wait(ctx, &r.loops); err == nil {
+		err = loopsErr
+	}
+	return err
+}
+
+// Runs f on its own goroutine, which Shutdown waits for. Returns false
+// without running f if the handler is shutting down.
+func (r *Rpc) spawn(f func()) bool {
+	r.lifeMu.Lock()
+	defer r.lifeMu.Unlock()
+	if r.stopped {
+		return false
+	}
+
+	r.handlers.Add(1)
+	go func() {
+		defer r.handlers.Done()
+		f()
+	}()
+	return true
+}
+
+// Waits for the wait group or for the context to be done.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Registers a function that is called whenever a connection has been added.
+func (r *Rpc) OnConnect(f func(conn net.Conn)) {
+	r.onConnect = append(r.onConnect, f)
+}
+
+// Registers a function that is called whenever a connection has been removed.
+// The error is nil if it was removed with RemoveConnection, and otherwise
+// tells why the connection broke.
+func (r *Rpc) OnDisconnect(f func(conn net.Conn, err error)) {
+	r.onDisconnect = append(r.onDisconnect, f)
+}
+
+// Sets how broken outbound connections are redialed. Attempts of 0 turns
+// redialing off.
+func (r *Rpc) SetRedial(delay time.Duration, maxDelay time.Duration, attempts int) {
+	r.redial = redialPolicy{
+		delay:    delay,
+		maxDelay: maxDelay,
+		attempts: attempts,
+	}
+}
+
+// Dials the address and adds the connection. If the connection breaks, it is
+// dialed again with exponential backoff.
+func (r *Rpc) Dial(address string) (net.Conn, error) {
+	conn, err := r.transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.addConnection(conn, address); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Returns the number of broken outbound connections that are being redialed.
+func (r *Rpc) Redialing() int {
+	r.redialingMu.Lock()
+	defer r.redialingMu.Unlock()
+	return len(r.redialing)
+}
+
+// Removes the connection and tells the OnDisconnect functions. Outbound
+// connections that broke are redialed, unless the peer was banned.
+func (r *Rpc) disconnect(conn net.Conn, err error) {
+	r.connsMu.Lock()
+	c, ok := r.conns[conn]
+	delete(r.conns, conn)
+	r.metrics.connections.Set(float64(len(r.conns)))
+	r.connsMu.Unlock()
+
+	conn.Close()
+	if !ok {
+		return
+	}
+	close(c.stop)
+	r.failPending(conn, ErrConnectionClosed)
+	r.failStreams(conn, ErrConnectionClosed)
+	r.log("%s lost connection to %s: %v", r.alias, conn.RemoteAddr(), err)
+
+	for _, f := range r.onDisconnect {
+		f(conn, err)
+	}
+
+	if err != nil && err != ErrBanned && c.address != "" {
+		address := c.address
+		r.spawn(func() { r.redialAddress(address) })
+	}
+}
+
+func (r *Rpc) redialAddress(address string) {
+	r.redialingMu.Lock()
+	if r.redialing[address] {
+		r.redialingMu.Unlock()
+		return
+	}
+	r.redialing[address] = true
+	r.redialingMu.Unlock()
+
+	defer func() {
+		r.redialingMu.Lock()
+		defer r.redialingMu.Unlock()
+		delete(r.redialing, address)
+	}()
+
+	delay := r.redial.delay
+	for i := 0; i < r.redial.attempts; i++ {
+		select {
+		case <-time.After(delay):
+		case <-r.closing:
+			return
+		}
+
+		if _, err := r.Dial(address); err == nil {
+			return
+		}
+
+		delay *= 2
+		if delay > r.redial.maxDelay {
+			delay = r.redial.maxDelay
+		}
+	}
+	r.log("%s gave up redialing %s", r.alias, address)
+}
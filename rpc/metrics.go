@@ -0,0 +1,113 @@
+package rpc
+
+import (
+	"dsys/metrics"
+	"sync"
+	"time"
+)
+
+// Counts the messages, bytes, errors, duplicate floods and handler latency of
+// each function. Every Rpc keeps one, see Rpc.Metrics.
+type Metrics struct {
+	registry    *metrics.Registry
+	messages    *metrics.CounterVec
+	bytes       *metrics.CounterVec
+	failures    *metrics.CounterVec
+	duplicates  *metrics.CounterVec
+	latency     *metrics.HistogramVec
+	connections *metrics.Gauge
+
+	mu        sync.Mutex
+	functions map[string]bool // The functions seen so far
+}
+
+type FunctionStats struct {
+	Received      uint64
+	Sent          uint64
+	BytesReceived uint64
+	BytesSent     uint64
+	Errors        uint64
+	Duplicates    uint64        // Flooded messages received again
+	HandlerTime   time.Duration // Total time spent handling received messages
+}
+
+// Returns metrics registered in the registry.
+func NewMetrics(registry *metrics.Registry) *Metrics {
+	return &Metrics{
+		registry:    registry,
+		messages:    registry.Counter("dsys_rpc_messages_total", "Messages sent and received.", "function", "direction"),
+		bytes:       registry.Counter("dsys_rpc_bytes_total", "Bytes of the frames sent and received.", "function", "direction"),
+		failures:    registry.Counter("dsys_rpc_errors_total", "Messages that could not be sent or handled.", "function", "direction"),
+		duplicates:  registry.Counter("dsys_rpc_duplicates_total", "Flooded messages dropped because they were seen before.", "function"),
+		latency:     registry.Histogram("dsys_rpc_handler_seconds", "Time spent handling received messages.", nil, "function"),
+		connections: registry.Gauge("dsys_rpc_connections", "Connections currently added.").With(),
+		functions:   make(map[string]bool),
+	}
+}
+
+// Received messages of functions we do not know are counted under this name,
+// so a peer can not make us keep series for every name it makes up.
+const unknownFunction = "unknown"
+
+// Returns the registry the metrics are kept in.
+func (ms *Metrics) Registry() *metrics.Registry {
+	return ms.registry
+}
+
+// Counts the messages passing through. Received messages of functions for
+// which known returns false are counted as unknown.
+func (ms *Metrics) middleware(known func(function string) bool) Middleware {
+	return func(next Handler) Handler {
+		return func(m Message) error {
+			start := time.Now()
+			err := next(m)
+			elapsed := time.Since(start)
+
+			function := m.Function
+			if m.Direction == Inbound && !known(function) {
+				function = unknownFunction
+			}
+			ms.see(function)
+			ms.messages.With(function, m.Direction.String()).Inc()
+			ms.bytes.With(function, m.Direction.String()).Add(float64(len(m.Frame)))
+			if m.Direction == Inbound {
+				ms.latency.With(function).Observe(elapsed.Seconds())
+			}
+			if err != nil {
+				ms.failures.With(function, m.Direction.String()).Inc()
+			}
+			return err
+		}
+	}
+}
+
+// Returns a copy of the counts of each function.
+func (ms *Metrics) Snapshot() map[string]FunctionStats {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	snapshot := make(map[string]FunctionStats, len(ms.functions))
+	for f := range ms.functions {
+		_, handled := ms.latency.With(f).Value()
+		snapshot[f] = FunctionStats{
+			Received:      uint64(ms.messages.With(f, Inbound.String()).Value()),
+			Sent:          uint64(ms.messages.With(f, Outbound.String()).Value()),
+			BytesReceived: uint64(ms.bytes.With(f, Inbound.String()).Value()),
+			BytesSent:     uint64(ms.bytes.With(f, Outbound.String()).Value()),
+			Errors:        uint64(ms.failures.With(f, Inbound.String()).Value() + ms.failures.With(f, Outbound.String()).Value()),
+			Duplicates:    uint64(ms.duplicates.With(f).Value()),
+			HandlerTime:   time.Duration(handled * float64(time.Second)),
+		}
+	}
+	return snapshot
+}
+
+func (ms *Metrics) duplicate(function string) {
+	ms.see(function)
+	ms.duplicates.With(function).Inc()
+}
+
+func (ms *Metrics) see(function string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.functions[function] = true
+}
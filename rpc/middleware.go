@@ -0,0 +1,186 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Whether a message is being received or sent.
+type Direction int
+
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+func (d Direction) String() string {
+	if d == Inbound {
+		return "received"
+	}
+	return "sent"
+}
+
+// A message passing through the middlewares. Frame is the whole encoded frame.
+type Message struct {
+	Conn      net.Conn
+	Function  string
+	Direction Direction
+	Frame     []byte
+}
+
+// Handles a message. An inbound message is decoded and given to its
+// registered function, and an outbound message is queued for its connection.
+type Handler func(m Message) error
+
+// A Middleware wraps a handler. It can look at the message, stop it by
+// returning an error without calling next, or look at the result of next.
+type Middleware func(next Handler) Handler
+
+var (
+	ErrPanic       = errors.New("rpc: handler panicked")
+	ErrRateLimited = errors.New("rpc: rate limit exceeded")
+	ErrTooLarge    = errors.New("rpc: message too large")
+)
+
+// Adds middlewares that wrap every received and every sent message. The first
+// middleware added is the outermost.
+func (r *Rpc) Use(middlewares ...Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+func (r *Rpc) inbound(m Message) error {
+	return r.chain(func(m Message) error {
+		return r.handleFrame(m.Conn, m.Frame)
+	})(m)
+}
+
+func (r *Rpc) outbound(m Message) error {
+	return r.chain(func(m Message) error {
+		return r.enqueue(m.Conn, m.Frame)
+	})(m)
+}
+
+// Wraps the handler in the middlewares, with our own metrics and the recorder
+// outermost so they also see messages the middlewares reject.
+func (r *Rpc) chain(h Handler) Handler {
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		h = r.middlewares[i](h)
+	}
+	h = r.metrics.middleware(r.known)(h)
+	return func(m Message) error {
+		r.record(m)
+		return h(m)
+	}
+}
+
+// Logs every message with how long it took to handle.
+func Logging(logger *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(m Message) error {
+			start := time.Now()
+			err := next(m)
+			if err != nil {
+				logger.Printf("%s %s %s (%d bytes, %v): %v", m.Direction, m.Function, m.Conn.RemoteAddr(), len(m.Frame), time.Since(start), err)
+			} else {
+				logger.Printf("%s %s %s (%d bytes, %v)", m.Direction, m.Function, m.Conn.RemoteAddr(), len(m.Frame), time.Since(start))
+			}
+			return err
+		}
+	}
+}
+
+// Turns a panic in a handler into an error, so one bad message can not take
+// down the node.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(m Message) (err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					err = fmt.Errorf("%w: %s: %v", ErrPanic, m.Function, v)
+				}
+			}()
+			return next(m)
+		}
+	}
+}
+
+// Rejects messages whose frame is larger than size bytes, in both directions.
+func MaxSize(size int) Middleware {
+	return func(next Handler) Handler {
+		return func(m Message) error {
+			if len(m.Frame) > size {
+				return fmt.Errorf("%w: %s is %d bytes", ErrTooLarge, m.Function, len(m.Frame))
+			}
+			return next(m)
+		}
+	}
+}
+
+// Drops received messages from connections that send more than perSecond
+// messages a second on average, allowing bursts of up to burst messages.
+func RateLimit(perSecond float64, burst int) Middleware {
+	limiter := &rateLimiter{
+		rate:    perSecond,
+		burst:   float64(burst),
+		buckets: make(map[net.Conn]*bucket),
+	}
+
+	return func(next Handler) Handler {
+		return func(m Message) error {
+			if m.Direction == Inbound && !limiter.allow(m.Conn) {
+				return fmt.Errorf("%w: %s", ErrRateLimited, m.Function)
+			}
+			return next(m)
+		}
+	}
+}
+
+// A token bucket for each connection.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[net.Conn]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// How long a bucket is kept after its connection was last heard from
+const bucketIdle = time.Minute
+
+func (l *rateLimiter) allow(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[conn]
+	if !ok {
+		// Forget the buckets of connections that have gone quiet
+		for c, b := range l.buckets {
+			if now.Sub(b.last) > bucketIdle {
+				delete(l.buckets, c)
+			}
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[conn] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
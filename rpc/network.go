@@ -0,0 +1,396 @@
+package rpc
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+	An in-memory network for tests. Every host gets a Transport from Host, and
+	connections between hosts go through simulated links that can delay, drop,
+	reorder and partition what is written on them. All random decisions come
+	from one seeded source, so the same seed makes the same decisions for the
+	same sequence of writes.
+
+	Loss and reordering act on whole writes, which the rpc handler always
+	makes one frame at a time. They model lost and reordered messages, and on
+	encrypted connections they break the connection like tampering would.
+*/
+
+var ErrNoListener = errors.New("rpc: no listener on address")
+
+// How a link between two hosts behaves.
+type Link struct {
+	Latency time.Duration // Added to every write
+	Jitter  time.Duration // Random extra latency, up to this much
+	Loss    float64       // Probability a write is dropped
+	Reorder float64       // Probability a write is held back by an extra latency
+}
+
+type Network struct {
+	mu        sync.Mutex
+	rand      *rand.Rand
+	listeners map[string]*memoryListener
+	links     map[[2]string]Link
+	fallback  Link
+	groups    map[string]int // Hosts in different groups are partitioned
+}
+
+// Returns an empty network whose random decisions are made from the seed.
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		rand:      rand.New(rand.NewSource(seed)),
+		listeners: make(map[string]*memoryListener),
+		links:     make(map[[2]string]Link),
+	}
+}
+
+// Returns the transport of the named host. Hosts should listen on their name.
+func (n *Network) Host(name string) Transport {
+	return &memoryTransport{network: n, host: name}
+}
+
+// Sets how the link between two hosts behaves, in both directions.
+func (n *Network) SetLink(a string, b string, link Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[linkKey(a, b)] = link
+}
+
+// Sets how links without their own settings behave.
+func (n *Network) SetDefaultLink(link Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.fallback = link
+}
+
+// Splits the hosts into groups that can not reach each other. Hosts that are
+// in no group can reach everyone.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, host := range group {
+			n.groups[host] = i + 1
+		}
+	}
+}
+
+// Removes all partitions.
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+func linkKey(a string, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// Decides what happens to a write from one host to another. Returns when it
+// is delivered, if it may overtake earlier writes, and false if it is dropped.
+func (n *Network) schedule(from string, to string) (time.Time, bool, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.groups[from] != 0 && n.groups[to] != 0 && n.groups[from] != n.groups[to] {
+		return time.Time{}, false, false
+	}
+
+	link, ok := n.links[linkKey(from, to)]
+	if !ok {
+		link = n.fallback
+	}
+
+	if link.Loss > 0 && n.rand.Float64() < link.Loss {
+		return time.Time{}, false, false
+	}
+	delay := link.Latency
+	if link.Jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(link.Jitter)))
+	}
+	reordered := link.Reorder > 0 && n.rand.Float64() < link.Reorder
+	if reordered {
+		delay += link.Latency + link.Jitter + time.Millisecond
+	}
+	return time.Now().Add(delay), reordered, true
+}
+
+type memoryTransport struct {
+	network *Network
+	host    string
+}
+
+// Returns a source for the random choices of a handler on the host, seeded
+// from the network, so the same hosts made in the same order choose alike.
+func (t *memoryTransport) seed() *rand.Rand {
+	n := t.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return rand.New(rand.NewSource(n.rand.Int63()))
+}
+
+func (t *memoryTransport) Listen(address string) (net.Listener, error) {
+	n := t.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.listeners[address]; ok {
+		return nil, fmt.Errorf("rpc: address %s already in use", address)
+	}
+	l := &memoryListener{
+		network: n,
+		addr:    memoryAddr(address),
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	n.listeners[address] = l
+	return l, nil
+}
+
+func (t *memoryTransport) Dial(address string) (net.Conn, error) {
+	n := t.network
+	n.mu.Lock()
+	l, ok := n.listeners[address]
+	n.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrNoListener, address)
+	}
+
+	toServer := makeStream()
+	toClient := makeStream()
+	client := &memoryConn{
+		network: n, local: memoryAddr(t.host), remote: l.addr,
+		in: toClient, out: toServer,
+	}
+	server := &memoryConn{
+		network: n, local: l.addr, remote: memoryAddr(t.host),
+		in: toServer, out: toClient,
+	}
+
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("%w %s", ErrNoListener, address)
+	}
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+type memoryListener struct {
+	network   *Network
+	addr      memoryAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.network.mu.Lock()
+		defer l.network.mu.Unlock()
+		delete(l.network.listeners, string(l.addr))
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+// One direction of a connection. Writes wait in a queue ordered by when they
+// are delivered.
+type stream struct {
+	mu       sync.Mutex
+	pending  packets
+	buffer   []byte    // Delivered but not yet read
+	last     time.Time // When the latest write in order is delivered
+	closed   bool      // No more writes will come
+	notify   chan struct{}
+	sequence int
+}
+
+type packet struct {
+	data     []byte
+	at       time.Time
+	sequence int // Keeps writes delivered at the same time in order
+}
+
+func makeStream() *stream {
+	return &stream{notify: make(chan struct{}, 1)}
+}
+
+// Queues a write. Unless it is reordered, it is not delivered before the
+// writes queued before it.
+func (s *stream) push(data []byte, at time.Time, reordered bool) {
+	s.mu.Lock()
+	if !reordered {
+		if at.Before(s.last) {
+			at = s.last
+		}
+		s.last = at
+	}
+	heap.Push(&s.pending, packet{data: data, at: at, sequence: s.sequence})
+	s.sequence++
+	s.mu.Unlock()
+	s.wake()
+}
+
+func (s *stream) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.wake()
+}
+
+func (s *stream) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+type memoryConn struct {
+	network *Network
+	local   memoryAddr
+	remote  memoryAddr
+	in      *stream
+	out     *stream
+
+	mu           sync.Mutex
+	closed       bool
+	readDeadline time.Time
+}
+
+func (c *memoryConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		closed, deadline := c.closed, c.readDeadline
+		c.mu.Unlock()
+		if closed {
+			return 0, net.ErrClosed
+		}
+
+		now := time.Now()
+		if !deadline.IsZero() && !now.Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		s := c.in
+		s.mu.Lock()
+		for len(s.buffer) == 0 && s.pending.Len() > 0 && !now.Before(s.pending[0].at) {
+			s.buffer = heap.Pop(&s.pending).(packet).data
+		}
+		if len(s.buffer) > 0 {
+			n := copy(b, s.buffer)
+			s.buffer = s.buffer[n:]
+			s.mu.Unlock()
+			return n, nil
+		}
+		if s.closed && s.pending.Len() == 0 {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		wait := time.Hour
+		if s.pending.Len() > 0 {
+			wait = s.pending[0].at.Sub(now)
+		}
+		s.mu.Unlock()
+		if !deadline.IsZero() && deadline.Sub(now) < wait {
+			wait = deadline.Sub(now)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (c *memoryConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+
+	if at, reordered, ok := c.network.schedule(string(c.local), string(c.remote)); ok {
+		c.out.push(append([]byte{}, b...), at, reordered)
+	}
+	return len(b), nil
+}
+
+func (c *memoryConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.out.close()
+	c.in.close()
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr  { return c.local }
+func (c *memoryConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.in.wake()
+	return nil
+}
+
+// Writes never block, so there is nothing for a write deadline to do.
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// A heap of packets, earliest delivery first.
+type packets []packet
+
+func (p packets) Len() int { return len(p) }
+func (p packets) Less(i, j int) bool {
+	if p[i].at.Equal(p[j].at) {
+		return p[i].sequence < p[j].sequence
+	}
+	return p[i].at.Before(p[j].at)
+}
+func (p packets) Swap(i, j int)       { p[i], p[j] = p[j], p[i] }
+func (p *packets) Push(x interface{}) { *p = append(*p, x.(packet)) }
+func (p *packets) Pop() interface{} {
+	old := *p
+	x := old[len(old)-1]
+	*p = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// What to do when a frame is sent to a connection whose queue is full.
+type OverflowPolicy int
+
+const (
+	Disconnect OverflowPolicy = iota // Remove the connection
+	DropOldest                       // Drop the oldest queued frame to make room
+	DropNewest                       // Drop the frame being sent
+)
+
+const defaultQueueSize = 1024
+
+var (
+	ErrQueueFull         = errors.New("rpc: outbound queue full")
+	ErrUnknownConnection = errors.New("rpc: connection has not been added")
+)
+
+// Sets the number of frames that can be queued for each connection, and what
+// happens when a queue is full. Takes effect for connections added afterwards.
+func (r *Rpc) SetQueue(size int, policy OverflowPolicy) {
+	r.queueSize = size
+	r.overflow = policy
+}
+
+// Registers a function that is called with errors that happened while
+// sending, instead of printing them.
+func (r *Rpc) OnError(f func(conn net.Conn, err error)) {
+	r.onError = append(r.onError, f)
+}
+
+func (r *Rpc) reportError(conn net.Conn, err error) {
+	if len(r.onError) == 0 {
+		fmt.Printf("%s: %v\n", r.alias, err)
+		return
+	}
+	for _, f := range r.onError {
+		f(conn, err)
+	}
+}
+
+// Puts the frame in the queue of the connection, following the overflow
+// policy if the queue is full.
+func (r *Rpc) enqueue(conn net.Conn, b []byte) error {
+	r.connsMu.RLock()
+	c, ok := r.conns[conn]
+	r.connsMu.RUnlock()
+	if !ok {
+		return ErrUnknownConnection
+	}
+
+	for {
+		select {
+		case c.queue <- b:
+			return nil
+		default:
+		}
+
+		switch r.overflow {
+		case DropNewest:
+			return ErrQueueFull
+		case DropOldest:
+			select {
+			case <-c.queue:
+				r.reportError(conn, ErrQueueFull)
+			default:
+			}
+		default:
+			r.disconnect(conn, ErrQueueFull)
+			return ErrQueueFull
+		}
+	}
+}
+
+// Writes the queued frames of the connection until it is removed. A failed
+// write removes the connection.
+func (r *Rpc) write(conn net.Conn, c *connection) {
+	defer close(c.drained)
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.drain:
+			for {
+				select {
+				case b := <-c.queue:
+					if !r.writeFrame(conn, c, b) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case b := <-c.queue:
+			if !r.writeFrame(conn, c, b) {
+				return
+			}
+		}
+	}
+}
+
+// Writes the frame and returns whether it succeeded. The connection is
+// removed if it did not.
+func (r *Rpc) writeFrame(conn net.Conn, c *connection, b []byte) bool {
+	if _, err := c.wire.Write(b); err != nil {
+		r.reportError(conn, err)
+		r.disconnect(conn, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,256 @@
+package rpc
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	A recording holds every frame sent and received after the handshake, in
+	the order they passed through the middlewares. Each record is written as
+
+		time (8) | direction (1) | peer length (2) | peer |
+		address length (2) | address | frame length (4) | frame
+
+	after a header that identifies the file. The time is in nanoseconds since
+	the Unix epoch, and the peer is the name bans use for the connection.
+	Frames are recorded before encryption.
+
+	Frames are recorded before they are handled, and the handlers run outside
+	the recorder, so frames of one connection are handled in the order they
+	are recorded, while frames of different connections may be handled in a
+	slightly different order than they are replayed in.
+*/
+
+const recordingHeader = "DSYSREC1"
+
+var ErrMalformedRecording = errors.New("rpc: malformed recording")
+
+// A frame sent or received on a connection.
+type Record struct {
+	Time      time.Time
+	Direction Direction
+	Peer      string // The name of the other side, which Bans also uses: "key:" and a hash of its key, or "addr:" and its address
+	Address   string // The remote address of the connection
+	Frame     []byte
+}
+
+// Returns the function of the recorded frame.
+func (rec Record) Function() string {
+	return frameFunction(rec.Frame)
+}
+
+// Writes records to a writer. Shared by copies of an Rpc.
+type recorder struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+// Records every frame sent and received from now on to the writer, which is
+// flushed after each record. A nil writer stops recording. Closing the writer
+// is left to the caller, after recording has stopped.
+func (r *Rpc) SetRecorder(w io.Writer) error {
+	r.recorder.mu.Lock()
+	defer r.recorder.mu.Unlock()
+	if r.recorder.w != nil {
+		r.recorder.w.Flush()
+		r.recorder.w = nil
+	}
+	if w == nil {
+		return nil
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(recordingHeader); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	r.recorder.w = bw
+	return nil
+}
+
+// Records the message. Recording stops at the first error, as a recording
+// with holes in it would not replay the same.
+func (r *Rpc) record(m Message) {
+	r.recorder.mu.Lock()
+	defer r.recorder.mu.Unlock()
+	if r.recorder.w == nil {
+		return
+	}
+
+	var pk *rsa.PublicKey
+	r.connsMu.RLock()
+	if c, ok := r.conns[m.Conn]; ok {
+		pk = c.pk
+	}
+	r.connsMu.RUnlock()
+
+	rec := Record{
+		Time:      time.Now(),
+		Direction: m.Direction,
+		Peer:      peerName(m.Conn, pk),
+		Address:   m.Conn.RemoteAddr().String(),
+		Frame:     m.Frame,
+	}
+	if err := writeRecord(r.recorder.w, rec); err != nil {
+		r.recorder.w = nil
+		r.reportError(m.Conn, fmt.Errorf("rpc: recording stopped: %w", err))
+	}
+}
+
+func writeRecord(w *bufio.Writer, rec Record) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(rec.Time.UnixNano()))
+	w.Write(b[:])
+	w.WriteByte(byte(rec.Direction))
+	writeString(w, rec.Peer)
+	writeString(w, rec.Address)
+	binary.BigEndian.PutUint32(b[:4], uint32(len(rec.Frame)))
+	w.Write(b[:4])
+	w.Write(rec.Frame)
+	return w.Flush()
+}
+
+func writeString(w *bufio.Writer, s string) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(len(s)))
+	w.Write(b[:])
+	w.WriteString(s)
+}
+
+// Reads the records of a recording one by one.
+type RecordReader struct {
+	r      *bufio.Reader
+	header bool // Set once the header has been read
+}
+
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{r: bufio.NewReader(r)}
+}
+
+// Returns the next record, or io.EOF at the end of the recording.
+func (rr *RecordReader) Next() (Record, error) {
+	if !rr.header {
+		header := make([]byte, len(recordingHeader))
+		if _, err := io.ReadFull(rr.r, header); err != nil || string(header) != recordingHeader {
+			return Record{}, fmt.Errorf("%w: bad header", ErrMalformedRecording)
+		}
+		rr.header = true
+	}
+
+	var b [8]byte
+	if _, err := io.ReadFull(rr.r, b[:]); err == io.EOF {
+		return Record{}, io.EOF
+	} else if err != nil {
+		return Record{}, fmt.Errorf("%w: %v", ErrMalformedRecording, err)
+	}
+	rec := Record{Time: time.Unix(0, int64(binary.BigEndian.Uint64(b[:])))}
+
+	direction, err := rr.r.ReadByte()
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: %v", ErrMalformedRecording, err)
+	}
+	rec.Direction = Direction(direction)
+
+	if rec.Peer, err = rr.readString(); err != nil {
+		return Record{}, err
+	}
+	if rec.Address, err = rr.readString(); err != nil {
+		return Record{}, err
+	}
+
+	if _, err := io.ReadFull(rr.r, b[:4]); err != nil {
+		return Record{}, fmt.Errorf("%w: %v", ErrMalformedRecording, err)
+	}
+	length := binary.BigEndian.Uint32(b[:4])
+	if length > frameHeaderSize+maxFrameSize {
+		return Record{}, fmt.Errorf("%w: frame of %d bytes", ErrMalformedRecording, length)
+	}
+	rec.Frame = make([]byte, length)
+	if _, err := io.ReadFull(rr.r, rec.Frame); err != nil {
+		return Record{}, fmt.Errorf("%w: %v", ErrMalformedRecording, err)
+	}
+	return rec, nil
+}
+
+func (rr *RecordReader) readString() (string, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(rr.r, b[:]); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrMalformedRecording, err)
+	}
+	s := make([]byte, binary.BigEndian.Uint16(b[:]))
+	if _, err := io.ReadFull(rr.r, s); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrMalformedRecording, err)
+	}
+	return string(s), nil
+}
+
+// Feeds a recording to the handlers, as if its frames were received again,
+// and returns once every record is handled. Frames we sent are only handled
+// if their function is flooded: those are what the recording node sent of
+// its own accord, like its blocks, while the ones it forwarded are dropped as
+// duplicates. Reserved functions are skipped, as nobody is on the other side
+// to answer them. The handler should have no connections.
+func (r *Rpc) Replay(recording io.Reader) error {
+	conns := make(map[string]net.Conn)
+	reader := NewRecordReader(recording)
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		function := rec.Function()
+		if strings.HasPrefix(function, "_") {
+			continue
+		}
+		if rec.Direction == Outbound && !r.flooding[function] {
+			continue
+		}
+
+		key := rec.Peer + " " + rec.Address
+		conn, ok := conns[key]
+		if !ok {
+			conn = replayConn{peer: rec.Peer, address: replayAddr(rec.Address)}
+			conns[key] = conn
+		}
+
+		if err := r.handleFrame(conn, rec.Frame); err != nil {
+			r.reportError(conn, err)
+		}
+	}
+}
+
+// The connection recorded frames are replayed from. Nothing can be read from
+// or written to it.
+type replayConn struct {
+	peer    string
+	address replayAddr
+}
+
+type replayAddr string
+
+func (a replayAddr) Network() string { return "replay" }
+func (a replayAddr) String() string  { return string(a) }
+
+func (c replayConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (c replayConn) Write(b []byte) (int, error)        { return 0, net.ErrClosed }
+func (c replayConn) Close() error                       { return nil }
+func (c replayConn) LocalAddr() net.Addr                { return replayAddr("replay") }
+func (c replayConn) RemoteAddr() net.Addr               { return c.address }
+func (c replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c replayConn) SetWriteDeadline(t time.Time) error { return nil }
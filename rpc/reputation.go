@@ -0,0 +1,219 @@
+package rpc
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How much a peer's score drops for each kind of misbehaviour.
+const (
+	PenaltyInvalidMessage   = 50 // A handler rejected the message, e.g. for a bad signature
+	PenaltyMalformedPayload = 20
+	PenaltyUnknownFunction  = 5
+	PenaltyRateLimited      = 2
+)
+
+const (
+	defaultBanThreshold = 100
+	defaultBanDuration  = 10 * time.Minute
+	// Points a peer earns back every second it behaves
+	scoreRecovery = 1
+)
+
+var ErrBanned = errors.New("rpc: peer is banned")
+
+// A peer that is not allowed to connect until the ban runs out. Peer is the
+// peer's key if it was known, and otherwise the address of its connection. A
+// host may hold many peers, behind a NAT or on one machine, so they are not
+// banned along with one of them, but a peer without a key can come back from
+// another port.
+type Ban struct {
+	Peer   string
+	Reason string
+	Until  time.Time
+}
+
+type score struct {
+	points  float64
+	updated time.Time
+}
+
+// Keeps a score for every peer that misbehaved, and bans the peers whose
+// score drops to the threshold.
+type reputation struct {
+	threshold float64
+	duration  time.Duration
+	scores    map[string]*score
+	bans      map[string]Ban
+	mu        sync.Mutex
+}
+
+func makeReputation(threshold int, duration time.Duration) *reputation {
+	return &reputation{
+		threshold: float64(threshold),
+		duration:  duration,
+		scores:    make(map[string]*score),
+		bans:      make(map[string]Ban),
+	}
+}
+
+// Sets how low a peer's score may drop before it is disconnected, and how long
+// it is banned for afterwards.
+func (r *Rpc) SetBanPolicy(threshold int, duration time.Duration) {
+	r.reputation.mu.Lock()
+	defer r.reputation.mu.Unlock()
+	r.reputation.threshold = float64(threshold)
+	r.reputation.duration = duration
+}
+
+// Lowers the score of the peer on the connection. If the score drops to the
+// ban threshold, the peer is disconnected and banned.
+func (r *Rpc) Penalize(conn net.Conn, penalty int, reason string) {
+	pk, _ := r.PeerKey(conn)
+	peer := peerName(conn, pk)
+
+	rep := r.reputation
+	rep.mu.Lock()
+	now := time.Now()
+	s, ok := rep.scores[peer]
+	if !ok {
+		s = &score{updated: now}
+		rep.scores[peer] = s
+	}
+	s.recover(now)
+	s.points -= float64(penalty)
+	banned := s.points <= -rep.threshold
+	if banned {
+		delete(rep.scores, peer)
+		rep.bans[peer] = Ban{Peer: peer, Reason: reason, Until: now.Add(rep.duration)}
+	}
+	rep.mu.Unlock()
+
+	r.log("%s penalized %s by %d: %s", r.alias, peer, penalty, reason)
+	if banned {
+		r.log("%s banned %s: %s", r.alias, peer, reason)
+		r.disconnectPeer(peer)
+	}
+}
+
+// Returns the score of the peer on the connection. Peers start at 0 and drop
+// below it when they misbehave.
+func (r *Rpc) Score(conn net.Conn) float64 {
+	pk, _ := r.PeerKey(conn)
+	peer := peerName(conn, pk)
+
+	r.reputation.mu.Lock()
+	defer r.reputation.mu.Unlock()
+	s, ok := r.reputation.scores[peer]
+	if !ok {
+		return 0
+	}
+	s.recover(time.Now())
+	return s.points
+}
+
+// Returns the bans that have not run out yet.
+func (r *Rpc) Bans() []Ban {
+	rep := r.reputation
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+
+	bans := []Ban{}
+	now := time.Now()
+	for peer, ban := range rep.bans {
+		if now.After(ban.Until) {
+			delete(rep.bans, peer)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Peer < bans[j].Peer })
+	return bans
+}
+
+// Lifts the ban of the peer and returns whether it was banned.
+func (r *Rpc) Unban(peer string) bool {
+	r.reputation.mu.Lock()
+	defer r.reputation.mu.Unlock()
+	_, ok := r.reputation.bans[peer]
+	delete(r.reputation.bans, peer)
+	return ok
+}
+
+// Lifts all bans and forgets all scores.
+func (r *Rpc) ClearBans() {
+	r.reputation.mu.Lock()
+	defer r.reputation.mu.Unlock()
+	r.reputation.bans = make(map[string]Ban)
+	r.reputation.scores = make(map[string]*score)
+}
+
+// Returns whether the peer is banned.
+func (rep *reputation) banned(peer string) bool {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	ban, ok := rep.bans[peer]
+	if !ok {
+		return false
+	}
+	if time.Now().After(ban.Until) {
+		delete(rep.bans, peer)
+		return false
+	}
+	return true
+}
+
+// Earns back the points for the time since the score was last updated.
+func (s *score) recover(now time.Time) {
+	s.points += now.Sub(s.updated).Seconds() * scoreRecovery
+	if s.points > 0 {
+		s.points = 0
+	}
+	s.updated = now
+}
+
+// Penalizes the peer on the connection for an error in a frame it sent.
+func (r *Rpc) penalizeError(conn net.Conn, err error) {
+	switch {
+	case errors.Is(err, ErrRejected):
+		r.Penalize(conn, PenaltyInvalidMessage, err.Error())
+	case errors.Is(err, ErrMalformedPayload), errors.Is(err, ErrMalformedFrame), errors.Is(err, ErrTooLarge):
+		r.Penalize(conn, PenaltyMalformedPayload, err.Error())
+	case errors.Is(err, ErrUnknownFunction):
+		r.Penalize(conn, PenaltyUnknownFunction, err.Error())
+	case errors.Is(err, ErrRateLimited):
+		r.Penalize(conn, PenaltyRateLimited, err.Error())
+	}
+}
+
+// Removes every connection to the peer.
+func (r *Rpc) disconnectPeer(peer string) {
+	var conns []net.Conn
+	r.connsMu.RLock()
+	for conn, c := range r.conns {
+		if peerName(conn, c.pk) == peer {
+			conns = append(conns, conn)
+		}
+	}
+	r.connsMu.RUnlock()
+
+	for _, conn := range conns {
+		r.disconnect(conn, ErrBanned)
+	}
+}
+
+// Returns the name scores and bans are kept under for the peer on the
+// connection: its key if it is known, and otherwise its address.
+func peerName(conn net.Conn, pk *rsa.PublicKey) string {
+	if pk != nil {
+		hash := sha256.Sum256(pk.N.Bytes())
+		return "key:" + hex.EncodeToString(hash[:8])
+	}
+	return "addr:" + conn.RemoteAddr().String()
+}
@@ -1,67 +1,279 @@
 package rpc
 
 import (
+	"crypto/rsa"
+	"dsys/metrics"
 	"fmt"
+	"math/rand"
 	"net"
 	"sync"
+	"time"
+)
+
+const (
+	defaultFloodCacheSize = 100000
+	defaultFloodCacheAge  = 10 * time.Minute
+	defaultFloodTTL       = 16
 )
 
 type Rpc struct {
-	conns map[net.Conn](chan struct{})
-	fns   map[string]func(net.Conn, []byte)
+	conns   map[net.Conn]*connection
+	connsMu sync.RWMutex
+	fns     map[string]handler
+	codecs  []Codec
+	onError []func(net.Conn, error)
+
+	middlewares []Middleware
+	metrics     *Metrics
+	recorder    *recorder
+
+	transport Transport
+	sk        *rsa.PrivateKey // Set if connections must be encrypted
+
+	network    string
+	genesis    []byte
+	identityMu sync.RWMutex
+
+	flooded  *floodCache
+	flooding map[string]bool
+	floodTTL uint8
+	rand     *rand.Rand // Guarded by randMu
+	randMu   sync.Mutex
+	fanout   map[string]int
+	topicOf  map[string]string
+	topics   map[string]bool // The topics we are subscribed to
+	topicsMu sync.Mutex
+	recent   *messageStore
+
+	reputation *reputation
 
-	flooded   map[string]bool
-	floodedMu sync.RWMutex
-	flooding  map[string]bool
+	pending   map[callKey]*call
+	pendingMu sync.Mutex
+	nextID    uint64
+
+	streams      map[streamKey]*StreamReader // Streams we opened
+	serving      map[streamKey]*Stream       // Streams opened by the other side
+	streamsMu    sync.Mutex
+	streamWindow int
+
+	onConnect    []func(net.Conn)
+	onDisconnect []func(net.Conn, error)
+	redial       redialPolicy
+	redialing    map[string]bool
+	redialingMu  sync.Mutex
+	closing      chan struct{}
+	closeOnce    sync.Once
+	antiEntropy  time.Duration
+
+	stopped  bool           // Set once Shutdown is called
+	lifeMu   sync.Mutex     // Guards stopped and adding to the wait groups
+	handlers sync.WaitGroup // Goroutines started with spawn
+	loops    sync.WaitGroup // Read and write loops of connections
+
+	queueSize int
+	overflow  OverflowPolicy
 
 	logging bool
 	alias   string
 }
 
+// The state kept about each added connection.
+type connection struct {
+	stop  chan struct{}
+	codec Codec
+	wire  net.Conn       // The connection itself, or the encrypted channel on top of it
+	pk    *rsa.PublicKey // The verified key of the other side, if encrypted
+
+	address   string          // The address we dialed, empty if the other side dialed us
+	functions map[string]bool // The functions the other side has registered
+	topics    map[string]bool // The topics the other side subscribed to, nil for all
+
+	queue     chan []byte   // Frames waiting to be written
+	drain     chan struct{} // Closed to make the writer write the queue and stop
+	drainOnce sync.Once
+	drained   chan struct{} // Closed when the writer has stopped
+}
+
 // Returns an RPC handler that you can add functions to.
 func MakeRpc(alias string, log bool) Rpc {
 	return Rpc{
-		conns: make(map[net.Conn]chan struct{}),
-		fns:   make(map[string]func(net.Conn, []byte)),
+		conns:  make(map[net.Conn]*connection),
+		fns:    make(map[string]handler),
+		codecs: []Codec{Binary, Gob, JSON},
+
+		metrics:  NewMetrics(metrics.NewRegistry()),
+		recorder: &recorder{},
 
-		flooded:  make(map[string]bool),
+		transport: TCP,
+
+		flooded:  makeFloodCache(defaultFloodCacheSize, defaultFloodCacheAge),
 		flooding: make(map[string]bool),
+		floodTTL: defaultFloodTTL,
+		rand:     rand.New(cryptoSource{}),
+		fanout:   make(map[string]int),
+		topicOf:  make(map[string]string),
+		topics:   make(map[string]bool),
+		recent:   makeMessageStore(defaultRecentSize, defaultRecentAge),
+
+		reputation: makeReputation(defaultBanThreshold, defaultBanDuration),
+
+		pending: make(map[callKey]*call),
+
+		streams:      make(map[streamKey]*StreamReader),
+		serving:      make(map[streamKey]*Stream),
+		streamWindow: defaultStreamWindow,
+
+		redial:    defaultRedialPolicy,
+		redialing: make(map[string]bool),
+		closing:   make(chan struct{}),
+
+		queueSize: defaultQueueSize,
+		overflow:  Disconnect,
 
 		logging: log,
 		alias:   alias,
 	}
 }
 
-// Starts listening on a connection
-func (r *Rpc) AddConnection(conn net.Conn) {
-	r.conns[conn] = r.Handle(conn)
+// Sets the codecs this handler can use for payloads, most preferred first.
+// Takes effect for connections added afterwards.
+func (r *Rpc) SetCodecs(codecs ...Codec) {
+	r.codecs = codecs
+}
+
+// Makes every connection added afterwards start with an authenticated key
+// exchange, where both sides prove that they own their public key. All frames
+// after that are encrypted. The other side must have enabled it too.
+func (r *Rpc) EnableEncryption(sk *rsa.PrivateKey) {
+	r.sk = sk
+}
+
+// Sets how many flooded message ids are remembered, and for how long. A
+// message arriving after its id has been forgotten is handled again.
+func (r *Rpc) SetFloodCache(size int, age time.Duration) {
+	r.flooded = makeFloodCache(size, age)
+}
+
+// Sets how many hops a flooded message travels before it is no longer
+// forwarded.
+func (r *Rpc) SetFloodTTL(ttl uint8) {
+	r.floodTTL = ttl
+}
+
+// Returns how often flooded messages were found in the cache.
+func (r *Rpc) FloodStats() FloodStats {
+	return r.flooded.stats()
+}
+
+// Returns the metrics of the messages sent and received. Other metrics can be
+// added to their registry to export them together.
+func (r *Rpc) Metrics() *Metrics {
+	return r.metrics
+}
+
+// Negotiates a codec with the other side of the connection, and a session key
+// if encryption is enabled, and starts listening on it. The connection is
+// closed if the handshake fails.
+func (r *Rpc) AddConnection(conn net.Conn) error {
+	return r.addConnection(conn, "")
 }
 
-// Stops listening on a connection
+func (r *Rpc) addConnection(conn net.Conn, address string) error {
+	c, err := r.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if r.reputation.banned(peerName(conn, c.pk)) {
+		conn.Close()
+		return ErrBanned
+	}
+	c.address = address
+	r.log("%s using codec %s with %s", r.alias, c.codec.Name(), conn.RemoteAddr())
+
+	// The loops are counted before Shutdown can start waiting for them
+	r.lifeMu.Lock()
+	if r.stopped {
+		r.lifeMu.Unlock()
+		conn.Close()
+		return ErrShutdown
+	}
+	r.connsMu.Lock()
+	r.conns[conn] = c
+	r.metrics.connections.Set(float64(len(r.conns)))
+	r.connsMu.Unlock()
+	r.loops.Add(2)
+	r.lifeMu.Unlock()
+
+	for _, f := range r.onConnect {
+		f(conn)
+	}
+
+	go func() {
+		defer r.loops.Done()
+		r.read(conn, c)
+	}()
+	go func() {
+		defer r.loops.Done()
+		r.write(conn, c)
+	}()
+	return nil
+}
+
+// Stops listening on a connection and closes it. It is not redialed.
 func (r *Rpc) RemoveConnection(conn net.Conn) {
-	close(r.conns[conn])
-	delete(r.conns, conn)
-	conn.Close()
+	r.disconnect(conn, nil)
 }
 
+// Removes every connection and stops redialing.
 func (r *Rpc) RemoveAllConnections() {
-	for conn, c := range r.conns {
-		close(c)
-		delete(r.conns, conn)
-		conn.Close()
+	r.closeOnce.Do(func() {
+		close(r.closing)
+	})
+	for _, conn := range r.Connections() {
+		r.RemoveConnection(conn)
 	}
 }
 
-func (r *Rpc) isFlooded(b []byte) bool {
-	r.floodedMu.RLock()
-	defer r.floodedMu.RUnlock()
-	return r.flooded[string(b)]
+// Returns the number of added connections.
+func (r *Rpc) ConnectionCount() int {
+	r.connsMu.RLock()
+	defer r.connsMu.RUnlock()
+	return len(r.conns)
 }
 
-func (r *Rpc) addFlooded(b []byte) {
-	r.floodedMu.Lock()
-	defer r.floodedMu.Unlock()
-	r.flooded[string(b)] = true
+// Returns the added connections.
+func (r *Rpc) Connections() []net.Conn {
+	r.connsMu.RLock()
+	defer r.connsMu.RUnlock()
+	conns := make([]net.Conn, 0, len(r.conns))
+	for conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Returns the verified public key of the other side of the connection. Only
+// known if the connection is encrypted.
+func (r *Rpc) PeerKey(conn net.Conn) (*rsa.PublicKey, bool) {
+	r.connsMu.RLock()
+	defer r.connsMu.RUnlock()
+	c, ok := r.conns[conn]
+	if !ok || c.pk == nil {
+		return nil, false
+	}
+	return c.pk, true
+}
+
+// Returns the codec negotiated for the connection, or JSON if the connection
+// has not been added.
+func (r *Rpc) codecFor(conn net.Conn) Codec {
+	r.connsMu.RLock()
+	defer r.connsMu.RUnlock()
+	if c, ok := r.conns[conn]; ok {
+		return c.codec
+	}
+	return JSON
 }
 
 func (r *Rpc) log(s string, args ...interface{}) {
@@ -0,0 +1,1241 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	networkSeed = 1
+	waitTimeout = 10 * time.Second
+)
+
+type binaryValue struct {
+	Flag    bool
+	Int     int64
+	Uint    uint16
+	Float   float64
+	String  string
+	Bytes   []byte
+	Empty   []int
+	Nil     []int
+	Array   [2]string
+	Map     map[string]int
+	Pointer *binaryValue
+	Big     big.Int
+	Neg     *big.Int
+	hidden  int
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	// Every supported kind decodes into what was encoded, nil slices are kept
+	// apart from empty ones, and equal maps encode into equal bytes
+	v := binaryValue{
+		Flag:    true,
+		Int:     -42,
+		Uint:    7,
+		Float:   1.5,
+		String:  "hello",
+		Bytes:   []byte{1, 2, 3},
+		Empty:   []int{},
+		Array:   [2]string{"a", "b"},
+		Map:     map[string]int{"a": 1, "b": 2, "c": 3},
+		Pointer: &binaryValue{String: "inner", Map: map[string]int{}},
+		Big:     *big.NewInt(1 << 40),
+		Neg:     big.NewInt(-5),
+	}
+	b, err := Binary.Marshal(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		again, _ := Binary.Marshal(&v)
+		if !bytes.Equal(b, again) {
+			t.Fatal("expected equal values to encode into equal bytes")
+		}
+	}
+
+	var decoded binaryValue
+	if err := Binary.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if v.Big.Cmp(&decoded.Big) != 0 || v.Neg.Cmp(decoded.Neg) != 0 {
+		t.Errorf("expected %v and %v, got %v and %v", &v.Big, v.Neg, &decoded.Big, decoded.Neg)
+	}
+	// Big integers are compared above, as equal ones can differ inside
+	v.Big, v.Neg, v.Pointer.Big = big.Int{}, nil, big.Int{}
+	decoded.Big, decoded.Neg, decoded.Pointer.Big = big.Int{}, nil, big.Int{}
+	if !reflect.DeepEqual(v, decoded) {
+		t.Errorf("expected %+v, got %+v", v, decoded)
+	}
+	if decoded.Empty == nil || decoded.Nil != nil {
+		t.Errorf("expected the empty slice to stay empty and the nil slice to stay nil")
+	}
+}
+
+func TestBinaryBadLengths(t *testing.T) {
+	// Truncated payloads and lengths longer than the payload are refused
+	// instead of read past the end or allocated
+	b, _ := Binary.Marshal(binaryValue{String: "hello", Bytes: []byte{1}, Map: map[string]int{"a": 1}})
+	for i := 0; i < len(b); i++ {
+		if err := Binary.Unmarshal(b[:i], new(binaryValue)); err == nil {
+			t.Errorf("expected a payload truncated to %d bytes to be refused", i)
+		}
+	}
+	if err := Binary.Unmarshal(append(b, 0), new(binaryValue)); err == nil {
+		t.Errorf("expected trailing bytes to be refused")
+	}
+
+	huge := make([]byte, binary.MaxVarintLen64)
+	huge = huge[:binary.PutUvarint(huge, 1<<62)]
+	for _, v := range []interface{}{new(string), new([]byte), new([]int), new(map[int]int)} {
+		if err := Binary.Unmarshal(huge, v); err != io.ErrUnexpectedEOF {
+			t.Errorf("expected an oversized length to be refused for %T, got %v", v, err)
+		}
+	}
+}
+
+func TestBadFrameLength(t *testing.T) {
+	// Frames shorter than their fixed fields or longer than the limit are
+	// refused before they are read
+	frame, _ := encodeMessage(JSON, "f", 0, "payload")
+	if _, err := readFrame(bytes.NewReader(frame)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readFrame(bytes.NewReader(frame[:len(frame)-1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected a truncated frame to be refused, got %v", err)
+	}
+	for _, length := range []uint32{frameFixedSize - 1, maxFrameSize + 1} {
+		bad := append([]byte{}, frame...)
+		binary.BigEndian.PutUint32(bad[1:offsetCodec], length)
+		if _, err := readFrame(bytes.NewReader(bad)); !errors.Is(err, ErrMalformedFrame) {
+			t.Errorf("expected a length of %d to be refused, got %v", length, err)
+		}
+	}
+}
+
+func TestFraming(t *testing.T) {
+	// Payloads arrive whole whatever bytes they hold, and frames of another
+	// version or with a function name longer than the frame are refused
+	network := NewNetwork(networkSeed)
+	a, b := createRpc("a"), createRpc("b")
+	received := make(chan string, 1)
+	b.RegisterFunction("echo", func(_ net.Conn, s string) {
+		received <- s
+	}, false)
+	ab, _ := connectRpcs(t, network, a, b)
+
+	payload := "an alias with spaces\nand a newline"
+	a.Send("echo", payload, ab, false)
+	select {
+	case s := <-received:
+		if s != payload {
+			t.Errorf("expected %q, got %q", payload, s)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("timed out waiting for the network")
+	}
+
+	frame, _ := encodeMessage(JSON, "echo", 0, payload)
+	m, err := decodeFrame(frame)
+	if err != nil || m.function != "echo" || m.decode(new(string)) != nil {
+		t.Errorf("expected the frame to decode, got %+v and error %v", m, err)
+	}
+	bad := append([]byte{}, frame...)
+	bad[0] = frameVersion + 1
+	if _, err := readFrame(bytes.NewReader(bad)); !errors.Is(err, ErrMalformedFrame) {
+		t.Errorf("expected another version to be refused, got %v", err)
+	}
+	bad = append([]byte{}, frame...)
+	binary.BigEndian.PutUint16(bad[offsetFunctionLength:offsetFunction], uint16(len(frame)))
+	if _, err := decodeFrame(bad); !errors.Is(err, ErrMalformedFrame) {
+		t.Errorf("expected a function name longer than the frame to be refused, got %v", err)
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	// Each side sends with its most preferred codec the other side supports,
+	// and peers without a common codec do not connect
+	network := NewNetwork(networkSeed)
+	a, b := createRpc("a"), createRpc("b")
+	a.SetCodecs(Binary, JSON)
+	b.SetCodecs(Gob, JSON, Binary)
+	b.RegisterCallable("echo", func(_ net.Conn, s string) (string, error) {
+		return s, nil
+	}, false)
+	ab, ba := connectRpcs(t, network, a, b)
+	if a.codecFor(ab) != Binary || b.codecFor(ba) != JSON {
+		t.Errorf("expected binary and json, got %s and %s", a.codecFor(ab).Name(), b.codecFor(ba).Name())
+	}
+	var s string
+	if err := a.Call(ab, "echo", "hello", &s, waitTimeout); err != nil || s != "hello" {
+		t.Errorf("expected an echo, got %q and error %v", s, err)
+	}
+
+	c, d := createRpc("c"), createRpc("d")
+	c.SetCodecs(JSON)
+	d.SetCodecs(Gob)
+	if cErr, dErr := connectPipe(c, d); !errors.Is(cErr, ErrNoCommonCodec) || !errors.Is(dErr, ErrNoCommonCodec) {
+		t.Errorf("expected no common codec on both sides, got %v and %v", cErr, dErr)
+	}
+}
+
+func TestHello(t *testing.T) {
+	// Peers on another network, with another genesis or speaking no common
+	// version are refused by both sides, and functions are only sent to peers
+	// that registered them
+	a, b := createRpc("a"), createRpc("b")
+	a.SetNetwork("main")
+	b.SetNetwork("test")
+	if aErr, bErr := connectPipe(a, b); !errors.Is(aErr, ErrIncompatible) || !errors.Is(bErr, ErrIncompatible) {
+		t.Errorf("expected another network to be refused, got %v and %v", aErr, bErr)
+	}
+
+	a, b = createRpc("a"), createRpc("b")
+	a.SetGenesis([]byte("genesis a"))
+	if aErr, bErr := connectPipe(a, b); aErr != nil || bErr != nil {
+		t.Errorf("expected a peer without a genesis to be accepted, got %v and %v", aErr, bErr)
+	}
+	a, b = createRpc("a"), createRpc("b")
+	a.SetGenesis([]byte("genesis a"))
+	b.SetGenesis([]byte("genesis b"))
+	if aErr, bErr := connectPipe(a, b); !errors.Is(aErr, ErrIncompatible) || !errors.Is(bErr, ErrIncompatible) {
+		t.Errorf("expected another genesis to be refused, got %v and %v", aErr, bErr)
+	}
+
+	ours := hello{Version: 3, MinVersion: 2}
+	for _, theirs := range []hello{{Version: 1, MinVersion: 1}, {Version: 5, MinVersion: 4}} {
+		if err := compatible(ours, theirs); !errors.Is(err, ErrIncompatible) {
+			t.Errorf("expected versions %d to %d to be refused, got %v", theirs.MinVersion, theirs.Version, err)
+		}
+	}
+	if err := compatible(ours, hello{Version: 4, MinVersion: 1}); err != nil {
+		t.Errorf("expected overlapping versions to be accepted, got %v", err)
+	}
+
+	network := NewNetwork(networkSeed)
+	a, b = createRpc("a"), createRpc("b")
+	a.RegisterFunction("new", func(net.Conn, string) {}, false)
+	ab, ba := connectRpcs(t, network, a, b)
+	if a.Supports(ab, "new") || !b.Supports(ba, "new") {
+		t.Errorf("expected only a to support the new function")
+	}
+	a.OnError(func(net.Conn, error) {})
+	frame, _ := encodeMessage(a.codecFor(ab), "new", 0, "")
+	if err := a.send(ab, frame); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected the new function not to be sent to b, got %v", err)
+	}
+}
+
+func TestRedial(t *testing.T) {
+	// Broken connections are removed and told about, and outbound ones are
+	// dialed again, unless we removed them ourselves
+	network := NewNetwork(networkSeed)
+	a, b := createRpc("a"), createRpc("b")
+	a.SetTransport(network.Host("a"))
+	a.SetRedial(10*time.Millisecond, 50*time.Millisecond, 5)
+	connected, disconnected := make(chan net.Conn, 4), make(chan error, 4)
+	a.OnConnect(func(conn net.Conn) { connected <- conn })
+	a.OnDisconnect(func(_ net.Conn, err error) { disconnected <- err })
+	l := listenRpc(t, network, b)
+	defer l.Close()
+
+	ab, err := a.Dial("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-connected
+	waitFor(t, func() bool { return b.ConnectionCount() == 1 })
+	b.RemoveConnection(b.Connections()[0])
+	if err := <-disconnected; err == nil {
+		t.Errorf("expected the broken connection to carry an error")
+	}
+	select {
+	case conn := <-connected:
+		if conn == ab || a.ConnectionCount() != 1 {
+			t.Errorf("expected a new connection to replace the broken one")
+		}
+		ab = conn
+	case <-time.After(waitTimeout):
+		t.Fatal("timed out waiting for the redial")
+	}
+
+	a.RemoveConnection(ab)
+	if err := <-disconnected; err != nil {
+		t.Errorf("expected no error for a removed connection, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if a.ConnectionCount() != 0 || a.Redialing() != 0 {
+		t.Errorf("expected a removed connection not to be redialed")
+	}
+}
+
+func TestQueueOverflow(t *testing.T) {
+	// A full queue drops the newest frame, the oldest, or the connection
+	cases := []struct {
+		policy    OverflowPolicy
+		delivered []int
+		connected bool
+	}{
+		{DropNewest, []int{1, 2, 3, 4}, true},
+		{DropOldest, []int{1, 2, 4, 5}, true},
+		{Disconnect, []int{1}, false},
+	}
+	for _, c := range cases {
+		a, b := createRpc("a"), createRpc("b")
+		a.SetQueue(2, c.policy)
+		a.OnError(func(net.Conn, error) {})
+		handling, release := make(chan struct{}, 1), make(chan struct{})
+		received := make(chan int, 5)
+		b.RegisterFunction("slow", func(_ net.Conn, v struct {
+			N       int
+			Padding string
+		}) {
+			received <- v.N
+			if v.N == 1 {
+				handling <- struct{}{}
+				<-release
+			}
+		}, false)
+		ab, ba := net.Pipe()
+		go b.AddConnection(ba)
+		if err := a.AddConnection(ab); err != nil {
+			t.Fatal(err)
+		}
+
+		// b stops reading while it handles the first frame, so the writer of a
+		// is stuck on the second, and the queue holds the next two
+		padding := string(make([]byte, 16<<10))
+		send := func(n int) error {
+			frame, _ := encodeMessage(JSON, "slow", 0, struct {
+				N       int
+				Padding string
+			}{n, padding})
+			return a.enqueue(ab, frame)
+		}
+		send(1)
+		<-handling
+		send(2)
+		waitFor(t, func() bool {
+			a.connsMu.RLock()
+			defer a.connsMu.RUnlock()
+			return len(a.conns[ab].queue) == 0
+		})
+		send(3)
+		send(4)
+		if err := send(5); (err == ErrQueueFull) != (c.policy != DropOldest) {
+			t.Errorf("policy %d: unexpected error %v", c.policy, err)
+		}
+		close(release)
+
+		got := []int{}
+		for range c.delivered {
+			select {
+			case n := <-received:
+				got = append(got, n)
+			case <-time.After(time.Second):
+			}
+		}
+		if !reflect.DeepEqual(got, c.delivered) {
+			t.Errorf("policy %d: expected %v to be delivered, got %v", c.policy, c.delivered, got)
+		}
+		if connected := a.ConnectionCount() == 1; connected != c.connected {
+			t.Errorf("policy %d: expected the connection to be kept: %v", c.policy, c.connected)
+		}
+		a.RemoveConnection(ab)
+	}
+}
+
+func TestFloodCache(t *testing.T) {
+	// The cache holds at most its size, forgets ids past their age and counts
+	// what it found
+	c := makeFloodCache(2, 100*time.Millisecond)
+	for _, id := range []uint64{1, 2, 3} {
+		if c.seen(id) {
+			t.Errorf("expected %d to be new", id)
+		}
+	}
+	if c.has(1) || !c.has(2) || !c.has(3) {
+		t.Errorf("expected only the 2 newest ids to be kept")
+	}
+	if !c.seen(3) {
+		t.Errorf("expected 3 to be seen")
+	}
+	if stats := c.stats(); stats != (FloodStats{Hits: 1, Misses: 3, Size: 2}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if c.has(3) || c.stats().Size != 0 {
+		t.Errorf("expected old ids to be forgotten")
+	}
+}
+
+func TestFloodTTL(t *testing.T) {
+	// A flooded message is handled once however many ways it arrives, and
+	// travels no more hops than its ttl
+	network := NewNetwork(networkSeed)
+	received := make(chan string, 10)
+	create := func(alias string, ttl uint8) *Rpc {
+		r := createRpc(alias)
+		r.SetFloodTTL(ttl)
+		r.RegisterFunction("news", func(net.Conn, string) {
+			received <- r.alias
+		}, true)
+		return r
+	}
+	expect := func(want map[string]int) {
+		t.Helper()
+		time.Sleep(100 * time.Millisecond)
+		got := map[string]int{}
+		for len(received) > 0 {
+			got[<-received]++
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	}
+
+	a, b, c, d := create("a", 2), create("b", 2), create("c", 2), create("d", 2)
+	connectRpcs(t, network, a, b)
+	connectRpcs(t, network, b, c)
+	connectRpcs(t, network, c, d)
+	a.Send("news", "", nil, true)
+	waitFor(t, func() bool { return len(received) == 2 })
+	expect(map[string]int{"b": 1, "c": 1})
+
+	x, y, z := create("x", defaultFloodTTL), create("y", defaultFloodTTL), create("z", defaultFloodTTL)
+	connectRpcs(t, network, x, y)
+	connectRpcs(t, network, x, z)
+	connectRpcs(t, network, y, z)
+	x.Send("news", "", nil, true)
+	waitFor(t, func() bool { return y.FloodStats().Hits+z.FloodStats().Hits > 0 })
+	expect(map[string]int{"y": 1, "z": 1})
+}
+
+func TestFanout(t *testing.T) {
+	// A flooded message is pushed to fanout neighbours, never back to its
+	// sender, and anti-entropy brings it to the ones it skipped
+	network := NewNetwork(networkSeed)
+	a := createRpc("a")
+	a.SetTransport(network.Host("a"))
+	a.SetFanout("news", 1)
+	a.RegisterFunction("news", func(net.Conn, string) {
+		t.Errorf("expected the message not to come back")
+	}, true)
+	received := make(chan string, 10)
+	neighbours := []*Rpc{createRpc("b"), createRpc("c"), createRpc("d")}
+	for _, r := range neighbours {
+		r := r
+		r.RegisterFunction("news", func(net.Conn, string) {
+			received <- r.alias
+		}, true)
+		connectRpcs(t, network, a, r)
+	}
+
+	a.Send("news", "", nil, true)
+	time.Sleep(100 * time.Millisecond)
+	if len(received) != 1 {
+		t.Errorf("expected 1 neighbour to receive the message, got %d", len(received))
+	}
+
+	a.SetAntiEntropy(10 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.Start(ctx)
+	waitFor(t, func() bool { return len(received) == len(neighbours) })
+	time.Sleep(100 * time.Millisecond)
+	got := map[string]bool{}
+	for len(received) > 0 {
+		alias := <-received
+		if got[alias] {
+			t.Errorf("expected %s to receive the message once", alias)
+		}
+		got[alias] = true
+	}
+}
+
+func TestEncryptedHandshake(t *testing.T) {
+	// Peers that own their keys talk over an encrypted channel, and a peer
+	// whose signature does not cover the transcript of this handshake is
+	// refused
+	network := NewNetwork(networkSeed)
+	a, b := createRpc("a"), createRpc("b")
+	a.EnableEncryption(createKey(t))
+	b.EnableEncryption(createKey(t))
+	b.RegisterCallable("echo", func(_ net.Conn, s string) (string, error) {
+		return s, nil
+	}, false)
+	ab, _ := connectRpcs(t, network, a, b)
+	var s string
+	if err := a.Call(ab, "echo", "hello", &s, waitTimeout); err != nil || s != "hello" {
+		t.Errorf("expected an echo, got %q and error %v", s, err)
+	}
+
+	cases := map[string]func(ours hello, theirs hello, reply *auth){
+		"reflected nonces": func(ours hello, theirs hello, reply *auth) {
+			reply.Signature = sign(t, b, transcript(ours.Nonce, theirs.Nonce, reply.Share))
+		},
+		"other share": func(ours hello, theirs hello, reply *auth) {
+			reply.Share = append([]byte{}, reply.Share...)
+			reply.Share[0] ^= 1
+		},
+		"other key": func(ours hello, theirs hello, reply *auth) {
+			c := createRpc("c")
+			c.EnableEncryption(createKey(t))
+			reply.Signature = sign(t, c, transcript(theirs.Nonce, ours.Nonce, reply.Share))
+		},
+	}
+	for name, tamper := range cases {
+		ba, ab := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- a.AddConnection(ab) }()
+
+		// b runs its side of the handshake by hand to tamper with its reply
+		ours := b.hello()
+		ours.Pk, ours.Nonce = &b.sk.PublicKey, make([]byte, nonceSize)
+		rand.Read(ours.Nonce)
+		var theirs hello
+		if err := exchange(ba, helloFunction, ours, &theirs); err != nil {
+			t.Fatal(err)
+		}
+		share, _ := rsa.EncryptOAEP(sha256.New(), rand.Reader, theirs.Pk, make([]byte, shareSize), shareLabel)
+		reply := auth{share, sign(t, b, transcript(theirs.Nonce, ours.Nonce, share))}
+		tamper(ours, theirs, &reply)
+		exchange(ba, authFunction, reply, &auth{})
+
+		if err := <-errs; !errors.Is(err, ErrBadHandshake) {
+			t.Errorf("%s: expected a bad handshake, got %v", name, err)
+		}
+		ba.Close()
+	}
+}
+
+func TestCall(t *testing.T) {
+	// A call returns the reply of the handler, its error, or the reason no
+	// reply came
+	network := NewNetwork(networkSeed)
+	a, b := createRpc("a"), createRpc("b")
+	release := make(chan struct{})
+	b.RegisterCallable("double", func(_ net.Conn, n int) (int, error) {
+		return 2 * n, nil
+	}, false)
+	b.RegisterCallable("fail", func(net.Conn, string) (string, error) {
+		return "", errors.New("failed")
+	}, false)
+	b.RegisterCallable("panic", func(net.Conn, string) (string, error) {
+		panic("oops")
+	}, false)
+	b.RegisterCallable("slow", func(net.Conn, string) (string, error) {
+		<-release
+		return "", nil
+	}, false)
+	ab, _ := connectRpcs(t, network, a, b)
+	defer close(release)
+
+	var n int
+	if err := a.Call(ab, "double", 21, &n, waitTimeout); err != nil || n != 42 {
+		t.Errorf("expected 42, got %d and error %v", n, err)
+	}
+	var remote RemoteError
+	if err := a.Call(ab, "fail", "", nil, waitTimeout); !errors.As(err, &remote) || remote != "failed" {
+		t.Errorf("expected the error of the handler, got %v", err)
+	}
+	if err := a.Call(ab, "panic", "", nil, waitTimeout); !errors.As(err, &remote) {
+		t.Errorf("expected a panic to be answered with an error, got %v", err)
+	}
+	if err := a.Call(ab, "slow", "", nil, 50*time.Millisecond); err != context.DeadlineExceeded {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := a.CallContext(ctx, ab, "slow", "", nil); err != context.Canceled {
+		t.Errorf("expected the call to be cancelled, got %v", err)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { a.RemoveConnection(ab) })
+	if err := a.Call(ab, "slow", "", nil, waitTimeout); err != ErrConnectionClosed {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+	a.pendingMu.Lock()
+	defer a.pendingMu.Unlock()
+	if len(a.pending) != 0 {
+		t.Errorf("expected no pending calls, got %d", len(a.pending))
+	}
+}
+
+func TestForgedReply(t *testing.T) {
+	// A reply is only taken from the connection the call was made on, and a
+	// peer answering a call made to another is penalized
+	network := NewNetwork(networkSeed)
+	a, b, c := createRpc("a"), createRpc("b"), createRpc("c")
+	release := make(chan struct{})
+	b.RegisterCallable("slow", func(net.Conn, string) (string, error) {
+		<-release
+		return "from b", nil
+	}, false)
+	ab, _ := connectRpcs(t, network, a, b)
+	ac, ca := connectRpcs(t, network, a, c)
+
+	result := make(chan string, 1)
+	go func() {
+		var s string
+		a.Call(ab, "slow", "", &s, waitTimeout)
+		result <- s
+	}()
+	var id uint64
+	waitFor(t, func() bool {
+		a.pendingMu.Lock()
+		defer a.pendingMu.Unlock()
+		for key := range a.pending {
+			id = key.id
+		}
+		return id != 0
+	})
+
+	forged, _ := encodeMessage(c.codecFor(ca), replyFunction, id, "from c")
+	c.SendRaw(forged, ca)
+	waitFor(t, func() bool { return a.Score(ac) < 0 })
+
+	close(release)
+	if s := <-result; s != "from b" {
+		t.Errorf("expected the reply of b, got %q", s)
+	}
+}
+
+func TestStreamCredit(t *testing.T) {
+	// The handler sends no more chunks than the receiver has credit for, and
+	// more as the receiver consumes them
+	network := NewNetwork(networkSeed)
+	a, b := createRpc("a"), createRpc("b")
+	a.SetStreamWindow(4)
+	var sent int32
+	b.RegisterStream("count", func(_ net.Conn, n int, s *Stream) error {
+		for i := 0; i < n; i++ {
+			if err := s.Send(i); err != nil {
+				return err
+			}
+			atomic.AddInt32(&sent, 1)
+		}
+		return nil
+	})
+	ab, _ := connectRpcs(t, network, a, b)
+
+	reader, err := a.OpenStream(context.Background(), ab, "count", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&sent) == 4 })
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&sent); n != 4 {
+		t.Errorf("expected 4 chunks sent before any was consumed, got %d", n)
+	}
+
+	for i := 0; i < 100; i++ {
+		var n int
+		if err := reader.Next(&n); err != nil || n != i {
+			t.Fatalf("expected chunk %d, got %d and error %v", i, n, err)
+		}
+	}
+	if err := reader.Next(new(int)); err != io.EOF {
+		t.Errorf("expected the stream to end, got %v", err)
+	}
+}
+
+func TestStreamOverflow(t *testing.T) {
+	// A sender ignoring its credit fails the stream once the chunks that fit
+	// are read
+	network := NewNetwork(networkSeed)
+	a, b := createRpc("a"), createRpc("b")
+	a.SetStreamWindow(2)
+	release := make(chan struct{})
+	b.RegisterStream("wait", func(net.Conn, string, *Stream) error {
+		<-release
+		return nil
+	})
+	ab, ba := connectRpcs(t, network, a, b)
+	defer close(release)
+
+	reader, err := a.OpenStream(context.Background(), ab, "wait", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		frame, _ := encodeMessage(b.codecFor(ba), chunkFunction, reader.id, i)
+		b.enqueue(ba, frame)
+	}
+	select {
+	case <-reader.failed:
+	case <-time.After(waitTimeout):
+		t.Fatal("timed out waiting for the stream to overflow")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := reader.Next(new(int)); err != nil {
+			t.Fatalf("expected the chunks that fit to be read, got %v", err)
+		}
+	}
+	if err := reader.Next(new(int)); err != ErrStreamOverflow {
+		t.Errorf("expected the stream to overflow, got %v", err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	// Closing the reader or cancelling its context stops the handler
+	network := NewNetwork(networkSeed)
+	a, b := createRpc("a"), createRpc("b")
+	a.SetStreamWindow(2)
+	stopped := make(chan error, 2)
+	b.RegisterStream("forever", func(_ net.Conn, _ string, s *Stream) error {
+		for {
+			if err := s.Send(0); err != nil {
+				stopped <- err
+				return err
+			}
+		}
+	})
+	ab, _ := connectRpcs(t, network, a, b)
+
+	reader, err := a.OpenStream(context.Background(), ab, "forever", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Next(new(int))
+	reader.Close()
+	if err := reader.Next(new(int)); err != ErrStreamCancelled {
+		t.Errorf("expected the stream to be cancelled, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err = a.OpenStream(ctx, ab, "forever", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Next(new(int))
+	cancel()
+	if err := reader.Next(new(int)); err != context.Canceled {
+		t.Errorf("expected the context to end the stream, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-stopped:
+			if err != ErrStreamCancelled {
+				t.Errorf("expected the handler to see the cancel, got %v", err)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatal("timed out waiting for the handler to stop")
+		}
+	}
+}
+
+func TestTopics(t *testing.T) {
+	// Messages of a topic only go to neighbours subscribed to it, following
+	// subscriptions made after connecting
+	network := NewNetwork(networkSeed)
+	a, b, c := createRpc("a"), createRpc("b"), createRpc("c")
+	received := map[*Rpc]chan string{b: make(chan string, 10), c: make(chan string, 10)}
+	for _, r := range []*Rpc{a, b, c} {
+		r := r
+		for _, function := range []string{"news", "other"} {
+			function := function
+			r.RegisterFunction(function, func(net.Conn, string) {
+				received[r] <- function
+			}, true)
+		}
+		r.SetTopic("news", "topic")
+	}
+	b.Subscribe("topic")
+	ab, _ := connectRpcs(t, network, a, b)
+	ac, _ := connectRpcs(t, network, a, c)
+
+	// Messages on a connection arrive in order, so once the message outside
+	// the topic arrives we know whether the one in it did
+	expect := func(r *Rpc, functions ...string) {
+		t.Helper()
+		for _, function := range append(functions, "other") {
+			select {
+			case got := <-received[r]:
+				if got != function {
+					t.Fatalf("%s: expected %s, got %s", r.alias, function, got)
+				}
+			case <-time.After(waitTimeout):
+				t.Fatal("timed out waiting for the network")
+			}
+		}
+	}
+	send := func() {
+		a.Send("news", "", nil, true)
+		a.Send("other", "", nil, true)
+	}
+
+	send()
+	expect(b, "news")
+	expect(c)
+
+	c.Subscribe("topic")
+	b.Unsubscribe("topic")
+	waitFor(t, func() bool { return a.interested(ac, "news") && !a.interested(ab, "news") })
+	send()
+	expect(b)
+	expect(c, "news")
+}
+
+func TestForgedStreamFrames(t *testing.T) {
+	// Chunks and the end of a stream are only taken from the connection it
+	// was opened on, so another peer can neither fill nor end it
+	network := NewNetwork(networkSeed)
+	a, b, c := createRpc("a"), createRpc("b"), createRpc("c")
+	a.SetStreamWindow(2)
+	release := make(chan struct{})
+	b.RegisterStream("count", func(_ net.Conn, n int, s *Stream) error {
+		<-release
+		for i := 0; i < n; i++ {
+			if err := s.Send(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	ab, _ := connectRpcs(t, network, a, b)
+	_, ca := connectRpcs(t, network, a, c)
+
+	reader, err := a.OpenStream(context.Background(), ab, "count", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		forged, _ := encodeMessage(c.codecFor(ca), chunkFunction, reader.id, 100)
+		c.SendRaw(forged, ca)
+	}
+	forged, _ := encodeMessage(c.codecFor(ca), endFunction, reader.id, "forged")
+	c.SendRaw(forged, ca)
+	time.Sleep(100 * time.Millisecond)
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		var n int
+		if err := reader.Next(&n); err != nil || n != i {
+			t.Fatalf("expected chunk %d, got %d and error %v", i, n, err)
+		}
+	}
+	if err := reader.Next(new(int)); err != io.EOF {
+		t.Errorf("expected the stream to end, got %v", err)
+	}
+}
+
+func TestNotForwarded(t *testing.T) {
+	// A flooded message the handler can not check yet is not forwarded, and
+	// the sender is not penalized for it
+	network := NewNetwork(networkSeed)
+	a, b, c := createRpc("a"), createRpc("b"), createRpc("c")
+	received := make(chan string, 2)
+	a.RegisterFunction("news", func(net.Conn, string) {}, true)
+	b.RegisterFunction("news", func(_ net.Conn, s string) error {
+		if s == "unchecked" {
+			return ErrNotForwarded
+		}
+		return nil
+	}, true)
+	c.RegisterFunction("news", func(_ net.Conn, s string) {
+		received <- s
+	}, true)
+	_, ba := connectRpcs(t, network, a, b)
+	connectRpcs(t, network, b, c)
+
+	a.Send("news", "unchecked", nil, true)
+	a.Send("news", "checked", nil, true)
+	select {
+	case s := <-received:
+		if s != "checked" {
+			t.Errorf("expected only the checked message to be forwarded, got %q", s)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("timed out waiting for the network")
+	}
+	if b.Score(ba) != 0 {
+		t.Errorf("expected the sender not to be penalized, got a score of %v", b.Score(ba))
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	// Middlewares wrap received and sent messages, the first added outermost,
+	// and the built-in ones turn panics, large messages and bursts into errors
+	network := NewNetwork(networkSeed)
+	a, b := createRpc("a"), createRpc("b")
+	var mu sync.Mutex
+	trace := []string{}
+	traced := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(m Message) error {
+				if m.Function == "ping" {
+					mu.Lock()
+					trace = append(trace, name+" "+m.Direction.String())
+					mu.Unlock()
+				}
+				return next(m)
+			}
+		}
+	}
+	errs := make(chan error, 10)
+	b.OnError(func(_ net.Conn, err error) { errs <- err })
+	b.Use(traced("outer"), traced("inner"), Recover(), MaxSize(200), RateLimit(0.001, 3))
+	pinged := make(chan struct{}, 10)
+	for _, r := range []*Rpc{a, b} {
+		r.RegisterFunction("ping", func(net.Conn, string) {
+			pinged <- struct{}{}
+		}, false)
+		r.RegisterFunction("panic", func(net.Conn, string) {
+			panic("oops")
+		}, false)
+	}
+	ab, ba := connectRpcs(t, network, a, b)
+	expect := func(target error) {
+		t.Helper()
+		select {
+		case err := <-errs:
+			if !errors.Is(err, target) {
+				t.Errorf("expected %v, got %v", target, err)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatal("timed out waiting for the error")
+		}
+	}
+
+	a.Send("ping", "", ab, false)
+	<-pinged
+	b.Send("ping", "", ba, false)
+	<-pinged
+	mu.Lock()
+	if want := []string{"outer received", "inner received", "outer sent", "inner sent"}; !reflect.DeepEqual(trace, want) {
+		t.Errorf("expected %v, got %v", want, trace)
+	}
+	mu.Unlock()
+
+	a.Send("panic", "", ab, false)
+	expect(ErrPanic)
+	a.Send("ping", string(make([]byte, 200)), ab, false)
+	expect(ErrTooLarge)
+	if b.Send("ping", string(make([]byte, 200)), ba, false); len(pinged) != 0 {
+		t.Errorf("expected a large message not to be sent")
+	}
+	expect(ErrTooLarge)
+
+	// The large message was stopped before the rate limit, so this one uses
+	// up the burst
+	a.Send("ping", "", ab, false)
+	<-pinged
+	a.Send("ping", "", ab, false)
+	expect(ErrRateLimited)
+}
+
+func TestUnknownFunctionMetrics(t *testing.T) {
+	// Functions we do not know are counted under one name, whatever the
+	// peer calls them
+	network := NewNetwork(networkSeed)
+	a, b := createRpc("a"), createRpc("b")
+	a.RegisterFunction("known", func(net.Conn, string) {}, false)
+	_, ba := connectRpcs(t, network, a, b)
+
+	for _, function := range []string{"made-up", "also-made-up", "_made-up"} {
+		frame, _ := encodeMessage(b.codecFor(ba), function, 0, "")
+		b.enqueue(ba, frame)
+	}
+	b.Send("known", "", ba, false)
+	waitFor(t, func() bool {
+		return a.Metrics().Snapshot()["known"].Received == 1
+	})
+
+	snapshot := a.Metrics().Snapshot()
+	if snapshot[unknownFunction].Received != 3 || snapshot[unknownFunction].Errors != 3 {
+		t.Errorf("expected 3 failed unknown messages, got %+v", snapshot[unknownFunction])
+	}
+	for function := range snapshot {
+		if function != "known" && function != unknownFunction && function != helloFunction {
+			t.Errorf("unexpected series for %s", function)
+		}
+	}
+}
+
+func TestRecorderDoesNotBlock(t *testing.T) {
+	// While recording, a slow handler does not hold up messages from other
+	// connections
+	network := NewNetwork(networkSeed)
+	a, b, c := createRpc("a"), createRpc("b"), createRpc("c")
+	release, handled := make(chan struct{}), make(chan string, 2)
+	a.RegisterFunction("slow", func(net.Conn, string) {
+		<-release
+		handled <- "slow"
+	}, false)
+	a.RegisterFunction("fast", func(net.Conn, string) {
+		handled <- "fast"
+	}, false)
+	a.SetRecorder(io.Discard)
+	_, ba := connectRpcs(t, network, a, b)
+	_, ca := connectRpcs(t, network, a, c)
+
+	b.Send("slow", "", ba, false)
+	time.Sleep(100 * time.Millisecond)
+	c.Send("fast", "", ca, false)
+	select {
+	case s := <-handled:
+		if s != "fast" {
+			t.Errorf("expected the fast message first, got %s", s)
+		}
+	case <-time.After(waitTimeout):
+		t.Error("timed out waiting for the fast message")
+	}
+	close(release)
+	<-handled
+}
+
+func TestBanSharedHost(t *testing.T) {
+	// Peers without a key are banned by the address of their connection, so
+	// a peer on the same host is not banned along with a bad one
+	a, bad, good := createRpc("a"), createRpc("bad"), createRpc("good")
+	a.SetBanPolicy(10, time.Minute)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go a.AddConnection(conn)
+		}
+	}()
+
+	badConn, err := bad.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	goodConn, err := good.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return a.ConnectionCount() == 2 })
+
+	for i := 0; i < 3; i++ {
+		frame, _ := encodeMessage(bad.codecFor(badConn), "made-up", 0, "")
+		bad.enqueue(badConn, frame)
+	}
+	waitFor(t, func() bool { return a.ConnectionCount() == 1 })
+
+	if bans := a.Bans(); len(bans) != 1 || bans[0].Peer != "addr:"+badConn.LocalAddr().String() {
+		t.Errorf("expected only the bad peer to be banned, got %+v", bans)
+	}
+	if conns := a.Connections(); conns[0].RemoteAddr().String() != goodConn.LocalAddr().String() {
+		t.Errorf("expected the good peer to stay connected")
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	// Links delay writes and partitions drop them until they are healed
+	network := NewNetwork(networkSeed)
+	x, y := dialHost(t, network, "x", "y")
+	read := func() string {
+		b := make([]byte, 16)
+		n, err := y.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b[:n])
+	}
+
+	network.SetLink("x", "y", Link{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	x.Write([]byte("slow"))
+	if s := read(); s != "slow" || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected the write to take the latency of the link, got %q after %v", s, time.Since(start))
+	}
+
+	network.SetLink("x", "y", Link{})
+	network.Partition([]string{"x"}, []string{"y"})
+	x.Write([]byte("lost"))
+	network.Heal()
+	x.Write([]byte("healed"))
+	if s := read(); s != "healed" {
+		t.Errorf("expected the write across the partition to be dropped, got %q", s)
+	}
+}
+
+func TestSeededLoss(t *testing.T) {
+	// Networks with the same seed lose the same writes
+	delivered := func() string {
+		network := NewNetwork(networkSeed)
+		x, y := dialHost(t, network, "x", "y")
+		network.SetLink("x", "y", Link{Loss: 0.5})
+		for _, c := range "abcdefghijklmnopqrst" {
+			x.Write([]byte{byte(c)})
+		}
+		network.SetLink("x", "y", Link{})
+		x.Write([]byte("."))
+
+		var s []byte
+		b := make([]byte, 1)
+		for len(s) == 0 || s[len(s)-1] != '.' {
+			if _, err := y.Read(b); err != nil {
+				t.Fatal(err)
+			}
+			s = append(s, b[0])
+		}
+		return string(s)
+	}
+	first, second := delivered(), delivered()
+	if first != second || len(first) == 21 || len(first) == 1 {
+		t.Errorf("expected the same writes to be lost, got %q and %q", first, second)
+	}
+}
+
+func TestSeededRand(t *testing.T) {
+	// Handlers on in-memory networks with the same seed draw the same flood
+	// ids, and handlers elsewhere draw unpredictable ones
+	ids := func(r *Rpc) []uint64 {
+		return []uint64{r.newFloodID(), r.newFloodID(), r.newFloodID()}
+	}
+	a, b, c := createRpc("a"), createRpc("a"), createRpc("a")
+	a.SetTransport(NewNetwork(networkSeed).Host("a"))
+	b.SetTransport(NewNetwork(networkSeed).Host("a"))
+	c.SetTransport(NewNetwork(networkSeed + 1).Host("a"))
+
+	first, second := ids(a), ids(b)
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("expected the same flood ids, got %v and %v", first, second)
+		}
+	}
+	if other := ids(c); other[0] == first[0] {
+		t.Errorf("expected another seed to give other flood ids")
+	}
+	if other := ids(createRpc("a")); other[0] == first[0] {
+		t.Errorf("expected an unseeded handler to give other flood ids")
+	}
+}
+
+func createRpc(alias string) *Rpc {
+	r := MakeRpc(alias, false)
+	return &r
+}
+
+func createKey(t *testing.T) *rsa.PrivateKey {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sk
+}
+
+func sign(t *testing.T, r *Rpc, hash []byte) []byte {
+	signature, err := rsa.SignPKCS1v15(rand.Reader, r.sk, crypto.SHA256, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+// Connects a to b over the network and returns the connection on each side.
+func connectRpcs(t *testing.T, network *Network, a *Rpc, b *Rpc) (net.Conn, net.Conn) {
+	address := a.alias + "-" + b.alias
+	l, err := network.Host(b.alias).Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil && b.AddConnection(conn) != nil {
+			conn = nil
+		}
+		accepted <- conn
+	}()
+
+	conn, err := network.Host(a.alias).Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddConnection(conn); err != nil {
+		t.Fatal(err)
+	}
+	other := <-accepted
+	if other == nil {
+		t.Fatal("the other side did not add the connection")
+	}
+	return conn, other
+}
+
+// Adds both ends of a pipe, one to each handler, and returns their errors.
+func connectPipe(a *Rpc, b *Rpc) (error, error) {
+	ab, ba := net.Pipe()
+	errs := make(chan error, 1)
+	go func() { errs <- b.AddConnection(ba) }()
+	err := a.AddConnection(ab)
+	return err, <-errs
+}
+
+// Dials from one host to another and returns both ends.
+func dialHost(t *testing.T, network *Network, from string, to string) (net.Conn, net.Conn) {
+	l, err := network.Host(to).Listen(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := network.Host(from).Dial(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, <-accepted
+}
+
+// Adds every connection made to the host of r until the listener is closed.
+func listenRpc(t *testing.T, network *Network, r *Rpc) net.Listener {
+	l, err := network.Host(r.alias).Listen(r.alias)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.AddConnection(conn)
+		}
+	}()
+	return l
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(waitTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the network")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,184 @@
+package rpc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"dsys/aes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+/*
+	The key exchange runs after the hellos, which carry the public key and a
+	random nonce of each side. Each side then sends a random share encrypted to
+	the public key of the other side, signed together with both nonces. Only the
+	owner of a private key can decrypt the share sent to it, and only the owner
+	can sign with it, so both sides know who they are talking to.
+
+	The session key is the hash of both shares and both nonces. Every frame is
+	then sealed with AES-GCM, using a nonce made from the direction and a
+	counter, so frames can neither be changed, replayed nor reordered.
+*/
+
+const (
+	authFunction   = "_auth"
+	shareSize      = 32
+	recordOverhead = 16 // The size of the GCM tag
+)
+
+var (
+	ErrBadHandshake = errors.New("rpc: bad handshake")
+	ErrBadRecord    = errors.New("rpc: bad encrypted record")
+)
+
+var shareLabel = []byte("dsys rpc session key share")
+
+type auth struct {
+	Share     []byte
+	Signature []byte
+}
+
+// Runs the key exchange and returns the encrypted channel on top of conn.
+func (r *Rpc) authenticate(conn net.Conn, ours hello, theirs hello) (net.Conn, error) {
+	if theirs.Pk.N == nil || len(theirs.Nonce) != nonceSize {
+		return nil, fmt.Errorf("%w: malformed hello", ErrBadHandshake)
+	}
+	if bytes.Equal(ours.Nonce, theirs.Nonce) {
+		return nil, fmt.Errorf("%w: equal nonces", ErrBadHandshake)
+	}
+
+	share := make([]byte, shareSize)
+	if _, err := rand.Read(share); err != nil {
+		return nil, err
+	}
+	encryptedShare, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, theirs.Pk, share, shareLabel)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := rsa.SignPKCS1v15(rand.Reader, r.sk, crypto.SHA256, transcript(theirs.Nonce, ours.Nonce, encryptedShare))
+	if err != nil {
+		return nil, err
+	}
+
+	var reply auth
+	if err := exchange(conn, authFunction, auth{encryptedShare, signature}, &reply); err != nil {
+		return nil, err
+	}
+
+	if rsa.VerifyPKCS1v15(theirs.Pk, crypto.SHA256, transcript(ours.Nonce, theirs.Nonce, reply.Share), reply.Signature) != nil {
+		return nil, fmt.Errorf("%w: invalid signature", ErrBadHandshake)
+	}
+	theirShare, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, r.sk, reply.Share, shareLabel)
+	if err != nil || len(theirShare) != shareSize {
+		return nil, fmt.Errorf("%w: invalid share", ErrBadHandshake)
+	}
+
+	// The side with the lowest nonce goes first, so both compute the same key
+	first := bytes.Compare(ours.Nonce, theirs.Nonce) < 0
+	var key [sha256.Size]byte
+	if first {
+		key = sha256.Sum256(bytes.Join([][]byte{share, theirShare, ours.Nonce, theirs.Nonce}, nil))
+	} else {
+		key = sha256.Sum256(bytes.Join([][]byte{theirShare, share, theirs.Nonce, ours.Nonce}, nil))
+	}
+
+	cipher, err := aes.AES(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &secureConn{
+		Conn:   conn,
+		cipher: cipher,
+	}
+	if first {
+		s.recvDirection = 1
+	} else {
+		s.sendDirection = 1
+	}
+	return s, nil
+}
+
+// Returns the hash that is signed to prove ownership of a public key. The
+// nonce of the receiver comes first so a signature can not be sent back.
+func transcript(receiverNonce []byte, senderNonce []byte, encryptedShare []byte) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{[]byte(authFunction), receiverNonce, senderNonce, encryptedShare}, nil))
+	return hash[:]
+}
+
+// An encrypted channel. Every write is sealed into one record, which is the
+// length of the ciphertext followed by the ciphertext.
+type secureConn struct {
+	net.Conn
+	cipher aes.Cipher
+
+	sendDirection byte
+	sendCounter   uint64
+	sendMu        sync.Mutex
+
+	recvDirection byte
+	recvCounter   uint64
+	plaintext     []byte // Read but not yet returned
+}
+
+func (s *secureConn) Write(b []byte) (int, error) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	ciphertext := s.cipher.Seal(recordNonce(s.sendDirection, s.sendCounter), b, nil)
+	s.sendCounter++
+
+	record := make([]byte, 4+len(ciphertext))
+	binary.BigEndian.PutUint32(record, uint32(len(ciphertext)))
+	copy(record[4:], ciphertext)
+
+	if _, err := s.Conn.Write(record); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Reads from the current record, or the next one if it has all been read.
+// Must not be called concurrently.
+func (s *secureConn) Read(b []byte) (int, error) {
+	for len(s.plaintext) == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(s.Conn, header[:]); err != nil {
+			return 0, err
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		if length < recordOverhead || length > frameHeaderSize+maxFrameSize+recordOverhead {
+			return 0, fmt.Errorf("%w: bad length %d", ErrBadRecord, length)
+		}
+
+		ciphertext := make([]byte, length)
+		if _, err := io.ReadFull(s.Conn, ciphertext); err != nil {
+			return 0, err
+		}
+
+		plaintext, err := s.cipher.Open(recordNonce(s.recvDirection, s.recvCounter), ciphertext, nil)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrBadRecord, err)
+		}
+		s.recvCounter++
+		s.plaintext = plaintext
+	}
+
+	n := copy(b, s.plaintext)
+	s.plaintext = s.plaintext[n:]
+	return n, nil
+}
+
+func recordNonce(direction byte, counter uint64) []byte {
+	nonce := make([]byte, aes.NonceSize)
+	nonce[0] = direction
+	binary.BigEndian.PutUint64(nonce[aes.NonceSize-8:], counter)
+	return nonce
+}
@@ -2,15 +2,73 @@ package rpc
 
 import (
 	"bufio"
-	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"reflect"
 )
 
-// Registers a function that the RPC handler will listen for.
-// Handler will be called on the payload when the given function is received.
-func (r *Rpc) RegisterFunction(function string, handler func(net.Conn, []byte), flooding bool) {
-	r.fns[function] = handler
+var (
+	ErrMalformedFrame   = errors.New("rpc: malformed frame")
+	ErrMalformedPayload = errors.New("rpc: malformed payload")
+	ErrUnknownFunction  = errors.New("rpc: function is not registered")
+	ErrRejected         = errors.New("rpc: message rejected")
+	ErrNotForwarded     = errors.New("rpc: message not forwarded")
+)
+
+var (
+	connType   = reflect.TypeOf((*net.Conn)(nil)).Elem()
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+	streamType = reflect.TypeOf((*Stream)(nil))
+)
+
+// A registered function. The payload is decoded into a new value of type arg
+// before fn is called with it.
+type handler struct {
+	fn      reflect.Value
+	arg     reflect.Type
+	returns bool
+	rejects bool
+	stream  bool
+}
+
+// Registers a function that the RPC handler will listen for. The handler must
+// be a func(net.Conn, T) and will be called with the decoded payload when the
+// given function is received. It may also be a func(net.Conn, T) error, in
+// which case a message it returns an error for is not flooded any further, and
+// the sender is penalized for it unless the error is ErrNotForwarded.
+func (r *Rpc) RegisterFunction(function string, handler interface{}, flooding bool) {
+	r.register(function, handler, false, flooding)
+}
+
+// Registers a function that can be called with Call. The handler must be a
+// func(net.Conn, T) (R, error). The value returned by the handler is sent back
+// to the caller, as is the error if it is not nil.
+func (r *Rpc) RegisterCallable(function string, handler interface{}, flooding bool) {
+	r.register(function, handler, true, flooding)
+}
+
+func (r *Rpc) register(function string, fn interface{}, returns bool, flooding bool) {
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func || t.NumIn() != 2 || t.In(0) != connType {
+		panic(fmt.Sprintf("rpc: handler of %s must take a net.Conn and a payload", function))
+	}
+	if returns && (t.NumOut() != 2 || t.Out(1) != errorType) {
+		panic(fmt.Sprintf("rpc: handler of %s must return a value and an error", function))
+	}
+	rejects := !returns && t.NumOut() == 1 && t.Out(0) == errorType
+	if !returns && !rejects && t.NumOut() != 0 {
+		panic(fmt.Sprintf("rpc: handler of %s must return nothing or an error", function))
+	}
+
+	r.fns[function] = handler{
+		fn:      reflect.ValueOf(fn),
+		arg:     t.In(1),
+		returns: returns,
+		rejects: rejects,
+	}
 	r.flooding[function] = flooding
 }
 
@@ -19,44 +77,204 @@ func (r *Rpc) UnRegisterFunction(function string) {
 	delete(r.fns, function)
 }
 
-// Returns a function that handles a received byte array on the specified TCP connection.
-func (r *Rpc) Handle(conn net.Conn) chan struct{} {
-	stop := make(chan struct{})
-	go func(net.Conn) {
-		reader := bufio.NewReader(conn)
-		for {
-			select {
-			case <-stop:
+// Decodes the payload of the message into the argument type of the handler.
+func (h handler) decode(m message) (reflect.Value, error) {
+	v := reflect.New(h.arg)
+	if err := m.decode(v.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	return v.Elem(), nil
+}
+
+// Calls the handler with a decoded payload and returns what it returned.
+func (h handler) call(conn net.Conn, arg reflect.Value) (interface{}, error) {
+	out := h.fn.Call([]reflect.Value{reflect.ValueOf(&conn).Elem(), arg})
+	if h.rejects {
+		err, _ := out[0].Interface().(error)
+		return nil, err
+	}
+	if !h.returns {
+		return nil, nil
+	}
+
+	if err, _ := out[1].Interface().(error); err != nil {
+		return nil, err
+	}
+	return out[0].Interface(), nil
+}
+
+// Reports whether the function is registered or reserved by the rpc.
+func (r *Rpc) known(function string) bool {
+	if _, ok := r.fns[function]; ok {
+		return true
+	}
+	switch function {
+	case replyFunction, errorFunction, helloFunction, authFunction,
+		digestFunction, wantFunction, subscribeFunction, unsubscribeFunction,
+		chunkFunction, endFunction, creditFunction, cancelFunction:
+		return true
+	}
+	return false
+}
+
+// Handles the frames received on the connection until it is removed.
+func (r *Rpc) read(conn net.Conn, c *connection) {
+	reader := bufio.NewReader(c.wire)
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+			frame, err := readFrame(reader)
+			if err != nil {
+				r.disconnect(conn, err)
 				return
-			default:
-				msg, err := reader.ReadBytes('\n')
-				if err != nil {
-					return
-				}
-				r.handleBytes(conn, msg)
+			}
+
+			err = r.inbound(Message{
+				Conn:      conn,
+				Function:  frameFunction(frame),
+				Direction: Inbound,
+				Frame:     frame,
+			})
+			if err != nil {
+				r.reportError(conn, err)
+				r.penalizeError(conn, err)
 			}
 		}
-	}(conn)
-	return stop
+	}
+}
+
+// Reads one whole frame from the reader.
+func readFrame(reader io.Reader) ([]byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != frameVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrMalformedFrame, header[0])
+	}
+
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length < frameFixedSize || length > maxFrameSize {
+		return nil, fmt.Errorf("%w: bad length %d", ErrMalformedFrame, length)
+	}
+
+	frame := make([]byte, frameHeaderSize+int(length))
+	copy(frame, header)
+	if _, err := io.ReadFull(reader, frame[frameHeaderSize:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
 }
 
-func (r *Rpc) handleBytes(conn net.Conn, b []byte) {
-	fp := bytes.Split(b, []byte(" ")) // function, payload
-	r.log("%s received %s", r.alias, fp[0])
+// Decodes a frame read by readFrame.
+func decodeFrame(b []byte) (message, error) {
+	codec, err := codecByID(b[offsetCodec])
+	if err != nil {
+		return message{}, err
+	}
 
-	flooding, ok := r.flooding[string(fp[0])]
+	n := int(binary.BigEndian.Uint16(b[offsetFunctionLength:offsetFunction]))
+	if len(b) < offsetFunction+n {
+		return message{}, fmt.Errorf("%w: function name too long", ErrMalformedFrame)
+	}
+
+	return message{
+		codec:    codec,
+		id:       binary.BigEndian.Uint64(b[offsetID:offsetFloodID]),
+		floodID:  binary.BigEndian.Uint64(b[offsetFloodID:offsetTTL]),
+		ttl:      b[offsetTTL],
+		function: string(b[offsetFunction : offsetFunction+n]),
+		payload:  b[offsetFunction+n:],
+	}, nil
+}
+
+// Handles a received frame. Returns an error if the frame could not be
+// handled.
+func (r *Rpc) handleFrame(conn net.Conn, b []byte) error {
+	m, err := decodeFrame(b)
+	if err != nil {
+		return err
+	}
+	r.log("%s received %s", r.alias, m.function)
+
+	switch m.function {
+	case replyFunction:
+		return r.resolve(conn, m.id, reply{message: m})
+	case errorFunction:
+		var s string
+		m.decode(&s)
+		return r.resolve(conn, m.id, reply{err: RemoteError(s)})
+	case digestFunction:
+		r.receivedDigest(conn, m)
+		return nil
+	case wantFunction:
+		r.receivedWant(conn, m)
+		return nil
+	case chunkFunction, endFunction, creditFunction, cancelFunction:
+		return r.receivedStreamFrame(conn, m)
+	case subscribeFunction, unsubscribeFunction:
+		return r.receivedSubscription(conn, m)
+	}
+
+	h, ok := r.fns[m.function]
 	if !ok {
-		fmt.Printf("received function %s which is not registered", string(fp[0]))
-		return
+		return fmt.Errorf("%w: %s", ErrUnknownFunction, m.function)
 	}
-	if flooding {
-		if !r.isFlooded(b) {
-			r.SendRaw(b, nil, true)
-		} else {
-			return
+
+	flooding := r.flooding[m.function] && m.floodID != 0
+	if flooding && r.flooded.seen(m.floodID) {
+		r.metrics.duplicate(m.function)
+		return nil
+	}
+
+	arg, err := h.decode(m)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrMalformedPayload, m.function, err)
+	}
+
+	if h.stream {
+		if m.id == 0 {
+			return fmt.Errorf("%w: %s is a stream but was not opened as one", ErrMalformedFrame, m.function)
+		}
+		s := r.acceptStream(conn, m)
+		if !r.spawn(func() { r.serveStream(s, h, arg) }) {
+			r.removeServing(s)
+		}
+		return nil
+	}
+	if m.id != 0 {
+		if flooding {
+			r.forward(conn, m, b)
+		}
+		r.spawn(func() { r.answer(conn, m, h, arg) })
+		return nil
+	}
+
+	// Messages are only flooded on once the handler accepted them, so peers
+	// that forward are not penalized for what others sent
+	if _, err := h.call(conn, arg); err != nil {
+		// The handler could not check the message yet, which is not the
+		// sender's fault
+		if errors.Is(err, ErrNotForwarded) {
+			return nil
 		}
+		return fmt.Errorf("%w: %s: %v", ErrRejected, m.function, err)
 	}
+	if flooding {
+		r.forward(conn, m, b)
+	}
+	return nil
+}
 
-	f := r.fns[string(fp[0])]
-	f(conn, fp[1][:len(fp[1])-1])
+// Floods the frame on to our other connections and keeps it for anti-entropy.
+// Forwarded frames keep the codec they were sent with, since every codec can be
+// decoded by every peer.
+func (r *Rpc) forward(from net.Conn, m message, b []byte) {
+	forward := forwardFrame(b)
+	r.recent.add(m.floodID, forward)
+	if m.ttl > 1 {
+		r.flood(m.function, forward, from)
+	}
 }
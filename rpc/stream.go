@@ -0,0 +1,402 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+)
+
+/*
+	A stream is opened like a call, with the function, its payload and a
+	stream id. The handler answers with any number of chunks and an end
+	marker, which carries the error of the handler if it failed. Chunks are
+	only sent while the receiver has granted credit for them: it grants a
+	window of chunks when opening the stream, and more as it consumes them,
+	so a slow receiver never has more than a window of chunks queued.
+*/
+
+// Reserved function names used by streams.
+const (
+	chunkFunction  = "_chunk"
+	endFunction    = "_end"
+	creditFunction = "_credit"
+	cancelFunction = "_cancel"
+
+	defaultStreamWindow = 32
+)
+
+var (
+	ErrStreamCancelled = errors.New("rpc: stream cancelled")
+	ErrStreamOverflow  = errors.New("rpc: stream sent more chunks than it had credit for")
+)
+
+// The sending side of a stream, given to the handler.
+type Stream struct {
+	r     *Rpc
+	conn  net.Conn
+	id    uint64
+	codec Codec
+
+	mu      sync.Mutex
+	credit  int
+	granted chan struct{} // Signaled when credit is granted
+
+	done     chan struct{} // Closed when the stream is cancelled or the connection closes
+	doneErr  error
+	doneOnce sync.Once
+}
+
+// The receiving side of a stream, returned by OpenStream.
+type StreamReader struct {
+	r    *Rpc
+	conn net.Conn
+	id   uint64
+	ctx  context.Context
+
+	window   int
+	consumed int // Chunks consumed since credit was last granted
+	items    chan streamItem
+	err      error // Set once the stream has ended
+
+	failed     chan struct{} // Closed when the connection closes
+	failedErr  error
+	failedOnce sync.Once
+}
+
+type streamItem struct {
+	message message
+	end     bool
+	err     error
+}
+
+// Stream ids are only unique per connection, and frames of a stream are only
+// taken from the connection it was opened on.
+type streamKey struct {
+	conn net.Conn
+	id   uint64
+}
+
+// Sets how many chunks of a stream may be sent before the receiver has
+// consumed any. Takes effect for streams opened afterwards.
+func (r *Rpc) SetStreamWindow(window int) {
+	r.streamWindow = window
+}
+
+// Registers a function that answers with a stream. The handler must be a
+// func(net.Conn, T, *Stream) error. The stream ends when the handler returns,
+// with the error of the handler if it is not nil.
+func (r *Rpc) RegisterStream(function string, fn interface{}) {
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func || t.NumIn() != 3 || t.In(0) != connType || t.In(2) != streamType {
+		panic(fmt.Sprintf("rpc: handler of %s must take a net.Conn, a payload and a *Stream", function))
+	}
+	if t.NumOut() != 1 || t.Out(0) != errorType {
+		panic(fmt.Sprintf("rpc: handler of %s must return an error", function))
+	}
+
+	r.fns[function] = handler{
+		fn:     reflect.ValueOf(fn),
+		arg:    t.In(1),
+		stream: true,
+	}
+	r.flooding[function] = false
+}
+
+// Opens a stream of the given function on the connection. The chunks are read
+// with Next until it returns io.EOF. The stream is cancelled when the context
+// is done.
+func (r *Rpc) OpenStream(ctx context.Context, conn net.Conn, function string, payload interface{}) (*StreamReader, error) {
+	window := r.streamWindow
+	s := &StreamReader{
+		r:      r,
+		conn:   conn,
+		ctx:    ctx,
+		window: window,
+		items:  make(chan streamItem, window+1),
+		failed: make(chan struct{}),
+	}
+
+	r.pendingMu.Lock()
+	r.nextID++
+	s.id = r.nextID
+	r.pendingMu.Unlock()
+
+	r.streamsMu.Lock()
+	r.streams[streamKey{conn, s.id}] = s
+	r.streamsMu.Unlock()
+
+	b, err := encodeMessage(r.codecFor(conn), function, s.id, payload)
+	if err == nil {
+		err = r.send(conn, b)
+	}
+	if err == nil {
+		err = s.grant(window)
+	}
+	if err != nil {
+		r.removeStream(s)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Decodes the next chunk of the stream into v. Returns io.EOF when the stream
+// has ended, or the error that ended it.
+func (s *StreamReader) Next(v interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.ctx.Err(); err != nil {
+		s.Close()
+		return s.end(err)
+	}
+
+	var item streamItem
+	select {
+	case item = <-s.items:
+	default:
+		select {
+		case item = <-s.items:
+		case <-s.failed:
+			return s.end(s.failedErr)
+		case <-s.ctx.Done():
+			s.Close()
+			return s.end(s.ctx.Err())
+		}
+	}
+
+	if item.end {
+		if item.err == nil {
+			item.err = io.EOF
+		}
+		return s.end(item.err)
+	}
+
+	// If the credit can not be sent the connection is gone, which the next
+	// call finds out once the chunks that did arrive are consumed
+	s.consumed++
+	if s.consumed >= s.window/2 || s.window < 2 {
+		s.grant(s.consumed)
+		s.consumed = 0
+	}
+	return item.message.decode(v)
+}
+
+// Stops the stream. The sender is told to stop sending chunks.
+func (s *StreamReader) Close() {
+	if s.err != nil {
+		return
+	}
+	s.end(ErrStreamCancelled)
+	b, err := encodeMessage(s.r.codecFor(s.conn), cancelFunction, s.id, nil)
+	if err == nil {
+		s.r.send(s.conn, b)
+	}
+}
+
+func (s *StreamReader) end(err error) error {
+	s.err = err
+	s.r.removeStream(s)
+	return err
+}
+
+// Allows the sender to send n more chunks.
+func (s *StreamReader) grant(n int) error {
+	b, err := encodeMessage(s.r.codecFor(s.conn), creditFunction, s.id, uint32(n))
+	if err != nil {
+		return err
+	}
+	return s.r.send(s.conn, b)
+}
+
+func (s *StreamReader) fail(err error) {
+	s.failedOnce.Do(func() {
+		s.failedErr = err
+		close(s.failed)
+	})
+}
+
+// Sends a chunk of the stream, waiting until the receiver has credit for it.
+// Returns an error if the stream was cancelled or the connection closed.
+func (s *Stream) Send(v interface{}) error {
+	for {
+		s.mu.Lock()
+		if s.credit > 0 {
+			s.credit--
+			s.mu.Unlock()
+			break
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.granted:
+		case <-s.done:
+			return s.doneErr
+		}
+	}
+
+	b, err := encodeMessage(s.codec, chunkFunction, s.id, v)
+	if err != nil {
+		return err
+	}
+	return s.r.send(s.conn, b)
+}
+
+// Returns a channel that is closed when the stream is cancelled by the
+// receiver or the connection closes.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Stream) grant(n int) {
+	s.mu.Lock()
+	s.credit += n
+	s.mu.Unlock()
+
+	select {
+	case s.granted <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Stream) stop(err error) {
+	s.doneOnce.Do(func() {
+		s.doneErr = err
+		close(s.done)
+	})
+}
+
+// Adds a stream opened by the other side. This happens before the handler
+// runs on its own goroutine, so credit that follows the opening message right
+// away finds the stream.
+func (r *Rpc) acceptStream(conn net.Conn, m message) *Stream {
+	s := &Stream{
+		r:       r,
+		conn:    conn,
+		id:      m.id,
+		codec:   m.codec,
+		granted: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	r.streamsMu.Lock()
+	r.serving[streamKey{conn, m.id}] = s
+	r.streamsMu.Unlock()
+	return s
+}
+
+// Runs the handler of a stream and ends the stream when it returns.
+func (r *Rpc) serveStream(s *Stream, h handler, arg reflect.Value) {
+	defer r.removeServing(s)
+
+	conn := s.conn
+	err := h.callStream(conn, arg, s)
+	select {
+	case <-s.done:
+		// The receiver is gone, so there is nobody to tell
+		return
+	default:
+	}
+
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+	}
+	b, encodeErr := encodeMessage(s.codec, endFunction, s.id, reason)
+	if encodeErr == nil {
+		r.send(conn, b)
+	}
+}
+
+// Calls the handler of a stream. A panic ends the stream with an error.
+func (h handler) callStream(conn net.Conn, arg reflect.Value, s *Stream) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("handler panicked: %v", v)
+		}
+	}()
+
+	out := h.fn.Call([]reflect.Value{reflect.ValueOf(&conn).Elem(), arg, reflect.ValueOf(s)})
+	err, _ = out[0].Interface().(error)
+	return err
+}
+
+// Handles the reserved functions of streams.
+func (r *Rpc) receivedStreamFrame(conn net.Conn, m message) error {
+	switch m.function {
+	case chunkFunction, endFunction:
+		r.streamsMu.Lock()
+		s, ok := r.streams[streamKey{conn, m.id}]
+		r.streamsMu.Unlock()
+		if !ok {
+			return nil
+		}
+
+		item := streamItem{message: m, end: m.function == endFunction}
+		if item.end {
+			var reason string
+			m.decode(&reason)
+			if reason != "" {
+				item.err = RemoteError(reason)
+			}
+		}
+
+		select {
+		case s.items <- item:
+		default:
+			s.fail(ErrStreamOverflow)
+			return ErrStreamOverflow
+		}
+	case creditFunction, cancelFunction:
+		r.streamsMu.Lock()
+		s, ok := r.serving[streamKey{conn, m.id}]
+		r.streamsMu.Unlock()
+		if !ok {
+			return nil
+		}
+
+		if m.function == cancelFunction {
+			s.stop(ErrStreamCancelled)
+			return nil
+		}
+		var n uint32
+		if err := m.decode(&n); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrMalformedPayload, m.function, err)
+		}
+		s.grant(int(n))
+	}
+	return nil
+}
+
+func (r *Rpc) removeServing(s *Stream) {
+	r.streamsMu.Lock()
+	defer r.streamsMu.Unlock()
+	delete(r.serving, streamKey{s.conn, s.id})
+}
+
+func (r *Rpc) removeStream(s *StreamReader) {
+	r.streamsMu.Lock()
+	defer r.streamsMu.Unlock()
+	delete(r.streams, streamKey{s.conn, s.id})
+}
+
+// Ends every stream on the given connection.
+func (r *Rpc) failStreams(conn net.Conn, err error) {
+	r.streamsMu.Lock()
+	defer r.streamsMu.Unlock()
+	for key, s := range r.streams {
+		if key.conn == conn {
+			s.fail(err)
+			delete(r.streams, key)
+		}
+	}
+	for key, s := range r.serving {
+		if key.conn == conn {
+			s.stop(err)
+			delete(r.serving, key)
+		}
+	}
+}
@@ -1,46 +1,182 @@
 package rpc
 
 import (
-	"bytes"
-	"encoding/json"
-	"log"
+	"encoding/binary"
+	"fmt"
 	"net"
 )
 
-// Sends the specified bytes to the given connection. If the given connection
-// is nil, sends the specified bytes to all added connections.
-func (r *Rpc) Send(function string, payload interface{}, conn net.Conn, flood bool) {
-	r.SendRaw(encodeMessage(function, payload), conn, flood)
+// Every frame starts with the version byte and the length of the rest of the
+// frame. The rest holds the codec of the payload, the call id, the flood id
+// and hops left of flooded messages, the length of the function name, the
+// function name and the payload:
+//
+//	version (1) | length (4) | codec (1) | id (8) | flood id (8) | ttl (1) |
+//	function length (2) | function | payload
+const (
+	frameVersion    = 3
+	frameHeaderSize = 1 + 4
+	frameFixedSize  = 1 + 8 + 8 + 1 + 2
+	maxFrameSize    = 64 << 20
+)
+
+// Offsets of the fields of a frame.
+const (
+	offsetCodec          = 5
+	offsetID             = 6
+	offsetFloodID        = 14
+	offsetTTL            = 22
+	offsetFunctionLength = 23
+	offsetFunction       = 25
+)
+
+type message struct {
+	codec    Codec
+	function string
+	id       uint64
+	floodID  uint64 // 0 unless the message is flooded
+	ttl      uint8
+	payload  []byte
 }
 
-func (r *Rpc) SendRaw(b []byte, conn net.Conn, flood bool) {
+// Sends the given function and payload to the given connection. If the given
+// connection is nil, sends it to all added connections interested in it. The
+// payload is encoded with the codec negotiated for each connection. Errors are
+// reported to the OnError functions.
+func (r *Rpc) Send(function string, payload interface{}, conn net.Conn, flood bool) {
+	m := message{function: function}
 	if flood {
-		r.addFlooded(b)
+		m.floodID = r.newFloodID()
+		m.ttl = r.floodTTL
+		r.flooded.seen(m.floodID)
 	}
-	fp := bytes.Split(b, []byte(" ")) // function, payload
-	r.log("%s sending %s", r.alias, fp[0])
 
-	if conn != nil {
-		_, err := conn.Write(b)
-		if err != nil {
-			log.Fatal(err)
-		}
-	} else {
-		for conn := range r.conns {
-			_, err := conn.Write(b)
+	conns := []net.Conn{conn}
+	if conn == nil && flood {
+		conns = r.floodTargets(function, nil)
+	} else if conn == nil {
+		conns = r.interestedIn(function)
+	}
+
+	frames := make(map[Codec][]byte)
+	for _, conn := range conns {
+		codec := r.codecFor(conn)
+		b, ok := frames[codec]
+		if !ok {
+			var err error
+			m.codec = codec
+			m.payload, err = marshalPayload(codec, payload)
 			if err != nil {
-				log.Fatal(err)
+				r.reportError(conn, err)
+				return
 			}
+			b = m.encode()
+			frames[codec] = b
+		}
+		r.SendRaw(b, conn)
+
+		if flood {
+			r.recent.add(m.floodID, b)
+		}
+	}
+}
+
+// Queues an encoded frame for the given connection, or for all added
+// connections interested in its function if the connection is nil. Does not
+// wait for it to be written. Returns the first error, after trying every
+// connection.
+func (r *Rpc) SendRaw(b []byte, conn net.Conn) error {
+	if conn != nil {
+		return r.send(conn, b)
+	}
+
+	var first error
+	for _, conn := range r.interestedIn(frameFunction(b)) {
+		if err := r.send(conn, b); err != nil && first == nil {
+			first = err
 		}
 	}
+	return first
+}
+
+// Passes a frame through the middlewares and queues it for the connection.
+// Errors are both reported and returned.
+func (r *Rpc) send(conn net.Conn, b []byte) error {
+	if !r.Supports(conn, frameFunction(b)) {
+		err := fmt.Errorf("%w: %s", ErrUnsupported, frameFunction(b))
+		r.reportError(conn, err)
+		return err
+	}
+	r.log("%s sending %s", r.alias, frameFunction(b))
+
+	err := r.outbound(Message{
+		Conn:      conn,
+		Function:  frameFunction(b),
+		Direction: Outbound,
+		Frame:     b,
+	})
+	if err != nil {
+		r.reportError(conn, err)
+	}
+	return err
 }
 
 // Encodes the given function with the given payload to be sent as an RPC.
-func encodeMessage(function string, payload interface{}) []byte {
-	payloadBytes, err := json.Marshal(payload)
+// The id is 0 unless the message is part of a call.
+func encodeMessage(codec Codec, function string, id uint64, payload interface{}) ([]byte, error) {
+	payloadBytes, err := marshalPayload(codec, payload)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return append(append([]byte(function+" "), payloadBytes...), '\n')
+	return message{
+		codec:    codec,
+		function: function,
+		id:       id,
+		payload:  payloadBytes,
+	}.encode(), nil
+}
+
+// Encodes the message as a frame.
+func (m message) encode() []byte {
+	length := frameFixedSize + len(m.function) + len(m.payload)
+	b := make([]byte, frameHeaderSize+length)
+
+	b[0] = frameVersion
+	binary.BigEndian.PutUint32(b[1:offsetCodec], uint32(length))
+	b[offsetCodec] = codecID(m.codec)
+	binary.BigEndian.PutUint64(b[offsetID:offsetFloodID], m.id)
+	binary.BigEndian.PutUint64(b[offsetFloodID:offsetTTL], m.floodID)
+	b[offsetTTL] = m.ttl
+	binary.BigEndian.PutUint16(b[offsetFunctionLength:offsetFunction], uint16(len(m.function)))
+	n := copy(b[offsetFunction:], m.function)
+	copy(b[offsetFunction+n:], m.payload)
+
+	return b
+}
+
+// Decodes the payload of the message into v.
+func (m message) decode(v interface{}) error {
+	return unmarshalPayload(m.codec, m.payload, v)
+}
+
+// Returns the function name of an encoded frame, used for logging.
+func frameFunction(b []byte) string {
+	if len(b) < frameHeaderSize+frameFixedSize {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint16(b[offsetFunctionLength:offsetFunction]))
+	if len(b) < offsetFunction+n {
+		return ""
+	}
+	return string(b[offsetFunction : offsetFunction+n])
+}
+
+// Returns a copy of a flooded frame with one hop less left.
+func forwardFrame(b []byte) []byte {
+	forward := append([]byte{}, b...)
+	if forward[offsetTTL] > 0 {
+		forward[offsetTTL]--
+	}
+	return forward
 }
@@ -0,0 +1,112 @@
+package rpc
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+/*
+	Functions can be put in a topic. Messages of a topic are only sent to
+	neighbours that subscribed to it, so peers that do not care about a topic
+	neither receive nor forward it. Subscriptions are sent in the hello, and
+	changes to them in subscribe and unsubscribe messages. Peers whose hello
+	has no topics get everything, as they do not know about topics.
+*/
+
+const (
+	subscribeFunction   = "_subscribe"
+	unsubscribeFunction = "_unsubscribe"
+)
+
+// Puts the function in the topic, so its messages are only sent to
+// neighbours subscribed to the topic.
+func (r *Rpc) SetTopic(function string, topic string) {
+	r.topicOf[function] = topic
+}
+
+// Subscribes to the topics and tells our neighbours.
+func (r *Rpc) Subscribe(topics ...string) {
+	r.topicsMu.Lock()
+	for _, topic := range topics {
+		r.topics[topic] = true
+	}
+	r.topicsMu.Unlock()
+	r.Send(subscribeFunction, topics, nil, false)
+}
+
+// Unsubscribes from the topics and tells our neighbours.
+func (r *Rpc) Unsubscribe(topics ...string) {
+	r.topicsMu.Lock()
+	for _, topic := range topics {
+		delete(r.topics, topic)
+	}
+	r.topicsMu.Unlock()
+	r.Send(unsubscribeFunction, topics, nil, false)
+}
+
+// Returns the topics we are subscribed to.
+func (r *Rpc) Subscriptions() []string {
+	r.topicsMu.Lock()
+	defer r.topicsMu.Unlock()
+	topics := make([]string, 0, len(r.topics))
+	for topic := range r.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Returns whether the peer on the connection supports the function and, if
+// the function is in a topic, is subscribed to it.
+func (r *Rpc) interested(conn net.Conn, function string) bool {
+	if !r.Supports(conn, function) {
+		return false
+	}
+	topic, ok := r.topicOf[function]
+	if !ok {
+		return true
+	}
+
+	r.connsMu.RLock()
+	defer r.connsMu.RUnlock()
+	c, ok := r.conns[conn]
+	return ok && (c.topics == nil || c.topics[topic])
+}
+
+// Returns the connections whose peers are interested in the function.
+func (r *Rpc) interestedIn(function string) []net.Conn {
+	conns := []net.Conn{}
+	for _, conn := range r.Connections() {
+		if r.interested(conn, function) {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// Records the topics a neighbour subscribed to or unsubscribed from.
+func (r *Rpc) receivedSubscription(conn net.Conn, m message) error {
+	var topics []string
+	if err := m.decode(&topics); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrMalformedPayload, m.function, err)
+	}
+
+	r.connsMu.Lock()
+	defer r.connsMu.Unlock()
+	c, ok := r.conns[conn]
+	if !ok {
+		return nil
+	}
+	if c.topics == nil {
+		c.topics = make(map[string]bool)
+	}
+	for _, topic := range topics {
+		if m.function == subscribeFunction {
+			c.topics[topic] = true
+		} else {
+			delete(c.topics, topic)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package rpc
+
+import (
+	"math/rand"
+	"net"
+)
+
+// A Transport makes the connections the rpc handler runs on.
+type Transport interface {
+	Dial(address string) (net.Conn, error)
+	Listen(address string) (net.Listener, error)
+}
+
+// The transport over real TCP connections.
+var TCP Transport = tcpTransport{}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(address string) (net.Conn, error) {
+	return net.Dial("tcp", address)
+}
+
+func (tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+// A transport that seeds the random choices of the handlers using it.
+type seeder interface {
+	seed() *rand.Rand
+}
+
+// Sets the transport Dial makes connections with. A transport of the
+// in-memory network also seeds the random choices of the handler.
+func (r *Rpc) SetTransport(t Transport) {
+	r.transport = t
+	if s, ok := t.(seeder); ok {
+		r.SetRand(s.seed())
+	}
+}
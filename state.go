@@ -0,0 +1,142 @@
+package dsys
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A block of the tree.
+type Block struct {
+	Hash         string // In hex
+	Slot         int
+	Length       int    // Blocks from the genesis to this block
+	Parent       string // The hash of the parent, empty for the genesis
+	Transactions []string
+	InChain      bool // Whether the block is on the chain we follow
+}
+
+// A peer of the network.
+type PeerInfo struct {
+	Alias   string
+	Address string
+	Account string // The key of the peer
+}
+
+// A peer that may not connect to us until the ban runs out.
+type Ban struct {
+	Peer   string // "key:" and a hash of its key, or "addr:" and its address if it had none
+	Reason string
+	Until  time.Time
+}
+
+// Returns the balance of every account, by alias and then key.
+func (p *Peer) Balances() []Balance {
+	p.ledger.accountsMu.RLock()
+	balances := make([]Balance, 0, len(p.ledger.Accounts))
+	for pk, balance := range p.ledger.Accounts {
+		balances = append(balances, Balance{
+			Account: pk,
+			Alias:   p.ledger.pkToAlias(pk),
+			Balance: balance,
+		})
+	}
+	p.ledger.accountsMu.RUnlock()
+
+	sort.Slice(balances, func(i, j int) bool {
+		if balances[i].Alias != balances[j].Alias {
+			return balances[i].Alias < balances[j].Alias
+		}
+		return balances[i].Account < balances[j].Account
+	})
+	return balances
+}
+
+// Returns the peers we know of, ourselves included.
+func (p *Peer) Peers() []PeerInfo {
+	p.peerInfoListMu.Lock()
+	defer p.peerInfoListMu.Unlock()
+	peers := make([]PeerInfo, len(p.peerInfoList))
+	for i, info := range p.peerInfoList {
+		peers[i] = PeerInfo{
+			Alias:   info.Alias,
+			Address: info.Address,
+			Account: encodePk(info.Pk),
+		}
+	}
+	return peers
+}
+
+// Returns the peers that are banned for misbehaving.
+func (p *Peer) Bans() []Ban {
+	bans := []Ban{}
+	for _, b := range p.rpc.Bans() {
+		bans = append(bans, Ban{Peer: b.Peer, Reason: b.Reason, Until: b.Until})
+	}
+	return bans
+}
+
+// Lets the peer, named as in its Ban, connect again.
+func (p *Peer) Unban(peer string) error {
+	if !p.rpc.Unban(peer) {
+		return fmt.Errorf("%w: %v", ErrNotBanned, peer)
+	}
+	return nil
+}
+
+// Lets every banned peer connect again, and forgets how peers misbehaved.
+func (p *Peer) ClearBans() {
+	p.rpc.ClearBans()
+}
+
+// Returns the last block of the chain we follow.
+func (p *Peer) Head() Block {
+	p.treeMu.RLock()
+	defer p.treeMu.RUnlock()
+	return p.blockOf(p.tree.current)
+}
+
+// Returns the blocks of the slot. There is more than one if the chain forked.
+func (p *Peer) BlocksAt(slot int) []Block {
+	p.treeMu.RLock()
+	defer p.treeMu.RUnlock()
+	blocks := []Block{}
+	if slot < 0 || slot >= len(p.tree.nodes) {
+		return blocks
+	}
+	for _, n := range p.tree.nodes[slot] {
+		blocks = append(blocks, p.blockOf(n))
+	}
+	return blocks
+}
+
+// Returns the block with the given hash, in hex.
+func (p *Peer) Block(hash string) (Block, error) {
+	h, err := hex.DecodeString(hash)
+	if err != nil {
+		return Block{}, fmt.Errorf("%w: %v", ErrUnknownBlock, hash)
+	}
+
+	p.treeMu.RLock()
+	defer p.treeMu.RUnlock()
+	if n := p.tree.find(h); n != nil {
+		return p.blockOf(n), nil
+	}
+	return Block{}, fmt.Errorf("%w: %v", ErrUnknownBlock, hash)
+}
+
+// treeMu must be held.
+func (p *Peer) blockOf(n *node) Block {
+	b := Block{
+		Hash:         hex.EncodeToString(n.hash()),
+		Slot:         n.Slot,
+		Length:       n.Length,
+		Transactions: append([]string{}, n.Transactions...),
+		InChain:      n.isAncestorOf(p.tree.current),
+	}
+	if n.parent != nil {
+		b.Parent = hex.EncodeToString(n.parent.hash())
+	}
+	return b
+}
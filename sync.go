@@ -0,0 +1,171 @@
+package dsys
+
+import (
+	"bytes"
+	"context"
+	"dsys/rpc"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+/*
+	A peer that joins after the genesis was broadcast catches up with the
+	chain before it draws in the lottery. It asks the peer it bootstrapped
+	from for the genesis and the slot it is in, and then streams the blocks
+	of every branch after its own head, each with its transactions. Blocks
+	come in the order of their slots, so parents come before their children,
+	and they are checked like blocks that are flooded.
+*/
+
+// How long catching up with the chain may take
+const syncTimeout = time.Minute
+
+// What a peer tells others that sync from it.
+type chainInfo struct {
+	Genesis *genesis // Nil if the chain has not started
+	Slot    int      // The slot the peer is in
+}
+
+// A block with the transactions it holds.
+type syncedBlock struct {
+	Block        block
+	Transactions []signedTransaction
+}
+
+func (p *Peer) sendGetChainInfo(conn net.Conn) (chainInfo, error) {
+	var info chainInfo
+	err := p.rpc.Call(conn, "getChainInfo", nil, &info, callTimeout)
+	return info, err
+}
+
+func (p *Peer) receivedGetChainInfo(conn net.Conn, _ struct{}) (chainInfo, error) {
+	p.treeMu.RLock()
+	defer p.treeMu.RUnlock()
+	return chainInfo{
+		Genesis: p.genesis,
+		Slot:    p.currentSlot(),
+	}, nil
+}
+
+// Streams our blocks after the slot.
+func (p *Peer) receivedGetBlocks(conn net.Conn, after int, s *rpc.Stream) error {
+	for _, sb := range p.blocksAfter(after) {
+		if err := s.Send(sb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the blocks of every branch after the slot, in the order of their
+// slots.
+func (p *Peer) blocksAfter(slot int) []syncedBlock {
+	p.treeMu.RLock()
+	defer p.treeMu.RUnlock()
+	p.transactionsMu.RLock()
+	defer p.transactionsMu.RUnlock()
+
+	blocks := []syncedBlock{}
+	for i := slot + 1; i < len(p.tree.nodes); i++ {
+		for _, n := range p.tree.nodes[i] {
+			// Our own blocks are kept once they are signed
+			if b, ok := p.blocks[n]; ok {
+				blocks = append(blocks, p.syncedBlockOf(b))
+			}
+		}
+	}
+	return blocks
+}
+
+// Returns the block with the transactions of it we have. transactionsMu must
+// be held.
+func (p *Peer) syncedBlockOf(b block) syncedBlock {
+	sb := syncedBlock{Block: b}
+	for _, id := range b.Transactions {
+		if st, ok := p.transactions[id]; ok {
+			sb.Transactions = append(sb.Transactions, st)
+		}
+	}
+	return sb
+}
+
+// Catches up with the chain of the peer on the other side of the connection.
+// Takes its genesis if we have none, moves our slot up to its slot, and adds
+// its blocks after our head.
+func (p *Peer) sync(ctx context.Context, conn net.Conn) error {
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+
+	info, err := p.sendGetChainInfo(conn)
+	if err != nil {
+		return err
+	}
+	if info.Genesis == nil {
+		// The genesis is flooded to us once the network starts
+		return nil
+	}
+
+	p.initializeGenesis(*info.Genesis)
+	p.treeMu.RLock()
+	same := bytes.Equal(hashObject(*p.genesis), hashObject(*info.Genesis))
+	head := p.tree.current.Slot
+	p.treeMu.RUnlock()
+	if !same {
+		return ErrOtherGenesis
+	}
+
+	// The slot loop has not started, so it is safe to move it on
+	p.blockInfoMu.Lock()
+	if info.Slot > p.blockInfo.slot {
+		p.blockInfo.slot = info.Slot
+		p.metrics.slot.Set(float64(info.Slot))
+	}
+	p.blockInfoMu.Unlock()
+
+	stream, err := p.rpc.OpenStream(ctx, conn, "getBlocks", head)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	synced := 0
+	for {
+		var sb syncedBlock
+		err := stream.Next(&sb)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, st := range sb.Transactions {
+			if err := p.receivedSignedTransaction(conn, st); err != nil {
+				return err
+			}
+		}
+		// Blocks we can not check yet are left out, as when flooded to us
+		if err := p.receivedBlock(conn, sb.Block); err != nil && !errors.Is(err, rpc.ErrNotForwarded) {
+			return err
+		}
+		synced++
+	}
+	fmt.Printf("%s synced %d blocks up to slot %d\n", p.info.Alias, synced, info.Slot)
+	return nil
+}
+
+// Returns whether we have the block already. treeMu must be held.
+func (p *Peer) knownBlock(b block) bool {
+	if b.Slot < 0 || b.Slot >= len(p.tree.nodes) {
+		return false
+	}
+	for _, n := range p.tree.nodes[b.Slot] {
+		if known, ok := p.blocks[n]; ok && bytes.Equal(known.Shb, b.Shb) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,8 @@
-package main
+package dsys
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"fmt"
 	"log"
 	"os"
@@ -9,9 +10,14 @@ import (
 
 type tree struct {
 	nodes   [][]*node
+	byHash  map[string]*node
 	current *node
 	longest int
 
+	forks      int // Blocks added next to another child of their parent
+	reorgs     int // Times we switched to another branch
+	reorgDepth int // Blocks undone by the last switch
+
 	run  func(n *node)
 	undo func(n *node)
 }
@@ -20,6 +26,10 @@ type node struct {
 	Slot         int
 	Transactions []string
 	Length       int
+	// Paid when the block is run, nil for the genesis. It is hashed, so that
+	// blocks of two winners are told apart even if they hold the same
+	// transactions.
+	Winner *rsa.PublicKey
 
 	parent   *node
 	children []*node
@@ -35,6 +45,7 @@ func makeTree(run func(n *node), undo func(n *node)) tree {
 	nodes := [][]*node{h}
 	return tree{
 		nodes:   nodes,
+		byHash:  map[string]*node{string(genisis.hash()): genisis},
 		current: genisis,
 
 		run:  run,
@@ -42,15 +53,24 @@ func makeTree(run func(n *node), undo func(n *node)) tree {
 	}
 }
 
-func (t *tree) insert(slot int, transactions []string, parentSlot int, parentHash []byte) {
-	parent := t.findParent(parentSlot, parentHash)
+// Adds a block to the tree and returns its node. The block becomes the head
+// if it makes the longest chain.
+func (t *tree) insert(slot int, transactions []string, parentSlot int, parentHash []byte, winner *rsa.PublicKey) (*node, error) {
+	parent, err := t.findParent(parentSlot, parentHash)
+	if err != nil {
+		return nil, err
+	}
 	n := &node{
 		Slot:         slot,
 		Transactions: transactions,
 		Length:       parent.Length + 1,
+		Winner:       winner,
 		parent:       parent,
 		children:     []*node{},
 	}
+	if len(parent.children) > 0 {
+		t.forks++
+	}
 	parent.children = append(parent.children, n)
 	t.append(n)
 
@@ -60,22 +80,30 @@ func (t *tree) insert(slot int, transactions []string, parentSlot int, parentHas
 	} else if n.Length == t.longest {
 		t.goTo(tieBreaker(t.current, n))
 	}
+	return n, nil
 }
 
-func (t *tree) insertNext(slot int, transactions []string) *node {
+func (t *tree) insertNext(slot int, transactions []string, winner *rsa.PublicKey) *node {
 	n := &node{
 		Slot:         slot,
 		Transactions: transactions,
 		Length:       t.current.Length + 1,
+		Winner:       winner,
 		parent:       t.current,
 		children:     []*node{},
 	}
 
+	if len(t.current.children) > 0 {
+		t.forks++
+	}
 	setParentChild(t.current, n)
 	t.append(n)
 
 	t.run(n)
 	t.current = n
+	if n.Length > t.longest {
+		t.longest = n.Length
+	}
 
 	return n
 }
@@ -91,19 +119,35 @@ func tieBreaker(nodes ...*node) *node {
 	return best
 }
 
+// Adds the node to its slot and to the index. If another node has the same
+// hash, the index keeps the first one, as findParent always did.
 func (t *tree) append(n *node) {
 	for len(t.nodes) <= n.Slot {
 		t.nodes = append(t.nodes, []*node{})
 	}
 	t.nodes[n.Slot] = append(t.nodes[n.Slot], n)
+	if _, ok := t.byHash[string(n.hash())]; !ok {
+		t.byHash[string(n.hash())] = n
+	}
+}
+
+// Returns the node with the given hash, or nil.
+func (t *tree) find(hash []byte) *node {
+	return t.byHash[string(hash)]
 }
 
 func (t *tree) goTo(n *node) {
 	var last *node
+	undone := 0
 	for !t.current.containsExcluded(n, last) {
 		t.undo(t.current)
 		last = t.current
 		t.current = t.current.parent
+		undone++
+	}
+	if undone > 0 {
+		t.reorgs++
+		t.reorgDepth = undone
 	}
 
 	x := n
@@ -154,19 +198,38 @@ func (n *node) contains(n2 *node) bool {
 	return false
 }
 
+// Returns whether n2 is n or one of its descendants, like contains, but walks
+// up from n2 instead of searching every branch below n.
+func (n *node) isAncestorOf(n2 *node) bool {
+	for n2 != nil && n2.Length > n.Length {
+		n2 = n2.parent
+	}
+	return n2 == n
+}
+
+// Returns the last node the chains ending at a and b have in common.
+func commonAncestor(a *node, b *node) *node {
+	for a != b {
+		if a.Length >= b.Length {
+			a = a.parent
+		} else {
+			b = b.parent
+		}
+	}
+	return a
+}
+
 func setParentChild(parent *node, child *node) {
 	parent.children = append(parent.children, child)
 	child.parent = parent
 }
 
-func (t *tree) findParent(parentSlot int, H []byte) *node {
-	for _, x := range t.nodes[parentSlot] {
-		if bytes.Equal(x.hash(), H) {
-			return x
-		}
+func (t *tree) findParent(parentSlot int, H []byte) (*node, error) {
+	// The hash covers the slot, so a node found by hash is in the slot
+	if x := t.find(H); x != nil && x.Slot == parentSlot {
+		return x, nil
 	}
-	log.Fatal("invalid parent")
-	return nil
+	return nil, ErrUnknownParent
 }
 
 func (n *node) hash() []byte {
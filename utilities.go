@@ -1,4 +1,4 @@
-package main
+package dsys
 
 import (
 	"crypto"
@@ -6,28 +6,18 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/json"
-	"errors"
-	"log"
+	"fmt"
 	"math/big"
 	"net"
-	"reflect"
 	"strconv"
 	"strings"
 )
 
-//manual implementation of max for integers
-func max(a int, b int) int {
-	if a > b {
-		return a
-	}
-	return b
-}
-
 //A way to get our IPv4 address
-func getLocalAddress(ln net.Listener) string {
+func getLocalAddress(ln net.Listener) (string, error) {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
-		println(err)
+		return "", err
 	}
 	defer conn.Close()
 
@@ -38,7 +28,7 @@ func getLocalAddress(ln net.Listener) string {
 	lnAddr := ln.Addr().String()
 	_, port, _ := net.SplitHostPort(lnAddr)
 
-	return strings.TrimSpace(ip + ":" + port)
+	return strings.TrimSpace(ip + ":" + port), nil
 }
 
 //encode public key to string
@@ -50,17 +40,17 @@ func encodePk(pk rsa.PublicKey) string {
 func decodePk(pk string) (*rsa.PublicKey, error) {
 	ne := strings.Split(pk, ",")
 	if len(ne) != 2 {
-		return nil, errors.New("bad public key encoding")
+		return nil, fmt.Errorf("%w: encoding", ErrBadKey)
 	}
 
 	n, ok := new(big.Int).SetString(ne[0], 10)
 	if !ok {
-		return nil, errors.New("bad encoding of n")
+		return nil, fmt.Errorf("%w: encoding of n", ErrBadKey)
 	}
 
 	e, err := strconv.Atoi(ne[1])
 	if err != nil {
-		return nil, errors.New("bad encoding of e")
+		return nil, fmt.Errorf("%w: encoding of e", ErrBadKey)
 	}
 
 	return &rsa.PublicKey{
@@ -69,36 +59,13 @@ func decodePk(pk string) (*rsa.PublicKey, error) {
 	}, nil
 }
 
-func tryConnect(address string) net.Conn {
-	conn, err := net.Dial("tcp", address)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return conn
-}
-
-func try(err error) {
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func tryUnmarshal(b []byte, v interface{}) {
-	err := json.Unmarshal(b, &v)
-	if err != nil {
-		log.Fatalf("%v: %v", reflect.TypeOf(v), err)
-	}
-	try(json.Unmarshal(b, &v))
-}
-
 // Returns the signature of the given data
-func (p *peer) sign(data ...interface{}) []byte {
-	signature, err := rsa.SignPKCS1v15(rand.Reader, p.sk, crypto.SHA256, hashObject(data))
-	if err != nil {
-		log.Fatal(err)
-	}
+func (p *Peer) sign(data ...interface{}) ([]byte, error) {
+	return signWith(p.sk, data...)
+}
 
-	return signature
+func signWith(sk *rsa.PrivateKey, data ...interface{}) ([]byte, error) {
+	return rsa.SignPKCS1v15(rand.Reader, sk, crypto.SHA256, hashObject(data))
 }
 
 func verifySignature(pk *rsa.PublicKey, signature []byte, data ...interface{}) bool {
@@ -110,10 +77,12 @@ func hashObject(v ...interface{}) []byte {
 	return hash[:]
 }
 
+// Only fails for types that can not be encoded as JSON, which is a bug rather
+// than something a peer can cause, so it panics.
 func objectToBytes(v ...interface{}) []byte {
 	bytes, err := json.Marshal(v)
 	if err != nil {
-		log.Fatal(err)
+		panic(err)
 	}
 	return bytes
 }
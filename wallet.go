@@ -0,0 +1,214 @@
+package dsys
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"sort"
+)
+
+// The states of a transaction.
+const (
+	Pending   = "pending"   // Waiting to be put in a block
+	Confirmed = "confirmed" // In a block of the chain
+	Failed    = "failed"    // In a block of the chain, but rejected by the ledger
+	Dropped   = "dropped"   // Neither waiting nor in the chain, as its block was undone
+)
+
+// The balance of an account.
+type Balance struct {
+	Account string // The key of the account
+	Alias   string // The alias of the account, if known
+	Balance int
+}
+
+// A transaction and how far it has come.
+type TransactionStatus struct {
+	ID            string
+	From          string // The alias of the sender, or its key if the alias is not known
+	To            string
+	Amount        int
+	State         string
+	Error         string // Why the ledger rejected the transaction, if it failed
+	Slot          int    // The slot of the block the transaction is in, if any
+	Confirmations int    // Blocks on top of that block, counting itself
+}
+
+// A transaction signed by its sender, as submitted to the API. From and To
+// are keys encoded with EncodeKey.
+type SignedTransaction struct {
+	ID        string
+	From      string
+	To        string
+	Amount    int
+	Signature []byte
+}
+
+// Signs the transaction with the key of the sender.
+func (st *SignedTransaction) Sign(sk *rsa.PrivateKey) error {
+	signature, err := signWith(sk, st.transaction())
+	if err != nil {
+		return err
+	}
+	st.Signature = signature
+	return nil
+}
+
+func (st *SignedTransaction) transaction() transaction {
+	return transaction{
+		ID:     st.ID,
+		From:   st.From,
+		To:     st.To,
+		Amount: st.Amount,
+	}
+}
+
+// Checks a transaction signed elsewhere the way one from a neighbour is
+// checked, and sends it to the network if it is valid.
+func (p *Peer) SubmitTransaction(st SignedTransaction) (TransactionStatus, error) {
+	if st.ID == "" {
+		return TransactionStatus{}, fmt.Errorf("%w: no id", ErrInvalidTransaction)
+	}
+	if st.Amount < 1 {
+		return TransactionStatus{}, ErrInvalidAmount
+	}
+	if _, err := decodePk(st.To); err != nil {
+		return TransactionStatus{}, err
+	}
+	if _, err := p.Transaction(st.ID); err == nil {
+		return TransactionStatus{}, fmt.Errorf("%w: %v", ErrKnownTransaction, st.ID)
+	}
+
+	signed := signedTransaction{
+		Transaction: st.transaction(),
+		Signature:   st.Signature,
+	}
+	if err := p.receivedSignedTransaction(nil, signed); err != nil {
+		return TransactionStatus{}, err
+	}
+	p.broadcastSignedTransaction(signed)
+	return p.Transaction(st.ID)
+}
+
+// Returns the balance of the account, given by its alias or key. An empty
+// account is the account of the peer.
+func (p *Peer) Balance(account string) (Balance, error) {
+	pk := encodePk(p.info.Pk)
+	if account != "" {
+		pk = p.ledger.account(account)
+		if pk == "" {
+			return Balance{}, fmt.Errorf("%w: %v", ErrUnknownAccount, account)
+		}
+	}
+
+	p.ledger.accountsMu.RLock()
+	defer p.ledger.accountsMu.RUnlock()
+	return Balance{
+		Account: pk,
+		Alias:   p.ledger.pkToAlias(pk),
+		Balance: p.ledger.Accounts[pk],
+	}, nil
+}
+
+// Returns the status of the transaction with the given id.
+func (p *Peer) Transaction(id string) (TransactionStatus, error) {
+	p.transactionsMu.RLock()
+	st, ok := p.transactions[id]
+	p.transactionsMu.RUnlock()
+	if !ok {
+		return TransactionStatus{}, fmt.Errorf("%w: %v", ErrUnknownTransaction, id)
+	}
+	return p.transactionStatus(st.Transaction, p.chainIndex()), nil
+}
+
+// Returns the status of every transaction to or from the peer, oldest first.
+// Transactions that are not in the chain come last.
+func (p *Peer) History() []TransactionStatus {
+	pk := encodePk(p.info.Pk)
+	index := p.chainIndex()
+
+	p.transactionsMu.RLock()
+	history := []TransactionStatus{}
+	for _, st := range p.transactions {
+		t := st.Transaction
+		if t.From == pk || t.To == pk {
+			history = append(history, p.transactionStatus(t, index))
+		}
+	}
+	p.transactionsMu.RUnlock()
+
+	sort.Slice(history, func(i, j int) bool {
+		a, b := history[i], history[j]
+		if (a.Slot == 0) != (b.Slot == 0) {
+			return b.Slot == 0
+		}
+		if a.Slot != b.Slot {
+			return a.Slot < b.Slot
+		}
+		return a.ID < b.ID
+	})
+	return history
+}
+
+// Where the transactions of the chain are.
+type chainIndex struct {
+	blocks map[string]blockTransaction // Where each transaction is first in the chain
+	head   int                         // The length of the chain
+}
+
+// Returns where each transaction is in the chain.
+func (p *Peer) chainIndex() chainIndex {
+	p.treeMu.RLock()
+	defer p.treeMu.RUnlock()
+
+	index := chainIndex{
+		blocks: make(map[string]blockTransaction),
+		head:   p.tree.current.Length,
+	}
+	for n := p.tree.current; n.parent != nil; n = n.parent {
+		for i := len(n.Transactions) - 1; i >= 0; i-- {
+			index.blocks[n.Transactions[i]] = blockTransaction{n, i}
+		}
+	}
+	return index
+}
+
+func (p *Peer) transactionStatus(t transaction, index chainIndex) TransactionStatus {
+	s := TransactionStatus{
+		ID:     t.ID,
+		From:   p.accountName(t.From),
+		To:     p.accountName(t.To),
+		Amount: t.Amount,
+	}
+
+	if bt, ok := index.blocks[t.ID]; ok {
+		s.State = Confirmed
+		s.Slot = bt.n.Slot
+		s.Confirmations = index.head - bt.n.Length + 1
+
+		p.failedMu.Lock()
+		if err, ok := p.failed[bt]; ok {
+			s.State = Failed
+			s.Error = err.Error()
+		}
+		p.failedMu.Unlock()
+		return s
+	}
+
+	s.State = Dropped
+	p.transactionsQueueMu.Lock()
+	for _, id := range p.transactionsQueue {
+		if id == t.ID {
+			s.State = Pending
+		}
+	}
+	p.transactionsQueueMu.Unlock()
+	return s
+}
+
+// Returns the alias of the account, or its key if the alias is not known.
+func (p *Peer) accountName(pk string) string {
+	if alias := p.ledger.pkToAlias(pk); alias != "" {
+		return alias
+	}
+	return pk
+}